@@ -1,6 +1,7 @@
 #!/bin/sh
 AF_TAG="AubeFaaS-ID"
 TMP_DIR="tmp"
+STATE_DIR="state"
 
 # remove old containers, networks and images
 containers=$(docker ps -a -q --filter label=$AF_TAG)
@@ -41,5 +42,9 @@ else
     echo "No tmp directory to remove. Skipping..."
 fi
 
-
-
+# remove persisted control plane state, it would only reference removed resources
+if [ -d "$STATE_DIR" ]; then
+    rm -rf "$STATE_DIR" > /dev/null || echo "Failed to remove directory $STATE_DIR ! Please remove it manually..."
+else
+    echo "No state directory to remove. Skipping..."
+fi
@@ -3,16 +3,25 @@ package main
 import (
 	"aube/pkg/controlplane"
 	"aube/pkg/docker"
+	"aube/pkg/rproxy"
+	"aube/pkg/util"
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -21,6 +30,10 @@ const (
 	ConfigPort          = 8090
 	RProxyConfigPort    = 8091
 	RProxyListenAddress = "localhost"
+	// StateFile is the default location of the persisted control plane state
+	StateFile = "./state/controlplane.json"
+	// ShutdownTimeout bounds how long the rproxy gets to drain its sessions on shutdown
+	ShutdownTimeout = 30 * time.Second
 )
 
 // For what do I need the Control Plane?
@@ -29,26 +42,130 @@ const (
 // - Communicating with the RProxy
 
 type server struct {
-	cp *controlplane.ControlPlane
+	cp   *controlplane.ControlPlane
+	auth *controlplane.Auth
+	// insecure serves the management API without credentials, only /scale and /scalein are protected
+	insecure bool
+	// mtls requires the client certificate of the rproxy on /scale and /scalein
+	mtls bool
 }
 
 func main() {
 	log.SetPrefix("cp: ")
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 
+	reconcile := flag.String("reconcile", string(controlplane.ReconcileNone), "what to do with docker resources of this instance which are not in its state: none (log them), remove or adopt")
+	reconcileIDs := flag.String("reconcile-ids", "", "comma separated ids of earlier instances whose docker resources are reconciled like the ones of this instance, * for every instance on the docker host")
+	stateFile := flag.String("state", StateFile, "file the state of the control plane is persisted in")
+	seccomp := flag.String("seccomp", "", "seccomp profile (JSON file) applied to untrusted function containers, docker default if empty")
+	trusted := flag.String("trusted", "", "comma separated names of functions whose containers run without the hardened profile")
+	drainGrace := flag.Duration("drain-grace", controlplane.DefaultDrainGrace, "time the containers of a replaced deployment may serve their sessions")
+	imageRetention := flag.Int("image-retention", controlplane.DefaultImageRetention, "amount of the newest versions of a function without an alias whose images are kept for a rollback")
+	healthInterval := flag.Duration("health-interval", controlplane.DefaultHealthInterval, "interval in which the health of every container is probed")
+	authConfig := flag.String("auth-config", "", "credentials (JSON file) of the management API and their roles")
+	insecure := flag.Bool("insecure", false, "serve the management API without credentials, only meant for local development")
+	tlsCert := flag.String("tls-cert", "", "certificate (PEM file) of the management API, which serves TLS if set")
+	tlsKey := flag.String("tls-key", "", "key (PEM file) of the certificate")
+	rproxyCert := flag.String("rproxy-tls-cert", "", "certificate (PEM file) of the user and config endpoint of the rproxy, which serve TLS if set")
+	rproxyKey := flag.String("rproxy-tls-key", "", "key (PEM file) of the certificate of the rproxy")
+	ca := flag.String("ca", "", "CA (PEM file) the control plane and the rproxy verify each other with, the system CAs if empty")
+	mtls := flag.Bool("mtls", false, "control plane and rproxy authenticate each other with their certificates, requires both certificates and -ca")
+	flag.Parse()
+
+	if len(RProxyBin) == 0 {
+		log.Printf("no rproxy is embedded for this platform, build the control plane with make")
+		os.Exit(1)
+	}
+
+	if *mtls && (*tlsCert == "" || *rproxyCert == "" || *ca == "") {
+		log.Printf("-mtls requires -tls-cert, -rproxy-tls-cert and -ca")
+		os.Exit(1)
+	}
+
+	if *authConfig == "" && !*insecure {
+		log.Printf("no credentials for the management API, set -auth-config or, for local development, -insecure")
+		os.Exit(1)
+	}
+
+	// the rproxy authenticates with it for /scale and requires it on its config endpoint
+	internalToken := controlplane.NewToken()
+
+	auth, err := loadAuth(*authConfig, internalToken)
+	if err != nil {
+		log.Printf("not able to load auth config: %v", err)
+		os.Exit(1)
+	}
+
 	log.Printf("controlplane started")
 
-	// start the proxy
-	rproxyArgs := []string{fmt.Sprintf("%s:%d", RProxyListenAddress, RProxyConfigPort)}
-	rproxyArgs = append(rproxyArgs, fmt.Sprintf("%s://%s:%d", "ws", RProxyListenAddress, 8083))
+	// the files are checked for renewed certificates on new connections
+	var reloader *util.CertReloader
+	if *tlsCert != "" {
+		reloader, err = util.NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Printf("not able to load certificate: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// start the proxy, it reaches the internal endpoints with the scheme of the management API
+	scheme := "http"
+	if reloader != nil {
+		scheme = "https"
+	}
+	rproxyArgs := []string{"-control-plane", fmt.Sprintf("%s://%s:%d", scheme, RProxyListenAddress, ConfigPort)}
+	if *rproxyCert != "" {
+		rproxyArgs = append(rproxyArgs, "-tls-cert", *rproxyCert, "-tls-key", *rproxyKey)
+	}
+	if *ca != "" {
+		rproxyArgs = append(rproxyArgs, "-ca", *ca)
+	}
+	if *mtls {
+		rproxyArgs = append(rproxyArgs, "-mtls")
+	}
 
 	log.Println("rproxy args: ", rproxyArgs)
 
-	id := uuid.New().String()
+	store, err := controlplane.NewFileStore(*stateFile)
+	if err != nil {
+		log.Printf("not able to create state store: %v", err)
+		os.Exit(1)
+	}
+
+	// The id is kept across restarts, so the resources of this instance can be recognized again
+	id, err := store.ID()
+	if err != nil {
+		log.Printf("not able to read id from the state store: %v", err)
+		os.Exit(1)
+	}
+
+	if id == "" {
+		id = uuid.New().String()
+		err = store.SetID(id)
+		if err != nil {
+			log.Printf("not able to persist id: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	// Creating Docker backend for the functions
 	// Only allow docker for now -> Many use more lightweight containerization in the future
-	backend, err := docker.New(id)
+	var seccompProfile []byte
+	if *seccomp != "" {
+		seccompProfile, err = os.ReadFile(*seccomp)
+		if err != nil {
+			log.Printf("not able to read seccomp profile: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// resources of earlier ids, e.g. of a lost state file, are reconciled like the ones of this instance
+	var earlierIDs []string
+	if *reconcileIDs != "" {
+		earlierIDs = strings.Split(*reconcileIDs, ",")
+	}
+
+	backend, err := docker.New(id, string(seccompProfile), earlierIDs)
 	if err != nil {
 		log.Printf("Not able to create Backend err: %v", err)
 		os.Exit(1)
@@ -73,6 +190,8 @@ func main() {
 	defer os.RemoveAll(rProxyDir)
 
 	c := exec.Command(rProxyPath, rproxyArgs...)
+	// not passed as an argument, so it does not show up in the process list
+	c.Env = append(os.Environ(), rproxy.InternalTokenEnv+"="+internalToken)
 
 	// Pipe that will be connected to the command's stdout when the command start
 	stdout, err := c.StdoutPipe()
@@ -113,44 +232,206 @@ func main() {
 
 	// Creating a ControlPlane instance
 
-	// TODO
-	cp := controlplane.New(uuid.New().String(), RProxyListenAddress, RProxyConfigPort, backend)
+	cp := controlplane.New(id, RProxyListenAddress, RProxyConfigPort, backend, store)
+	cp.DrainGrace = *drainGrace
+	cp.ImageRetention = *imageRetention
+	cp.HealthInterval = *healthInterval
+	if *trusted != "" {
+		cp.Trusted = strings.Split(*trusted, ",")
+	}
+	cp.RProxyToken = internalToken
+
+	if *rproxyCert != "" {
+		var clientCert *util.CertReloader
+		if *mtls {
+			clientCert = reloader
+		}
+
+		rproxyTLS, err := util.ClientTLS(*ca, clientCert)
+		if err != nil {
+			log.Printf("not able to load CA: %v", err)
+			os.Exit(1)
+		}
+		cp.SetRProxyTLS(rproxyTLS)
+	}
+
+	// Report containers which crash or run out of memory
+	cp.Watch()
+
+	// Functions which were deployed before the restart are still running
+	err = cp.Restore()
+	if err != nil {
+		log.Printf("restoring functions failed with err: %v", err)
+	}
+
+	// Clean up or take over what this instance left behind outside its state (e.g. after a crash)
+	err = cp.Reconcile(controlplane.ReconcilePolicy(*reconcile))
+	if err != nil {
+		log.Printf("reconciling resources of earlier runs failed with err: %v", err)
+	}
+
+	// Evict and replace containers which stop answering their health checks
+	cp.MonitorHealth()
 
 	s := &server{
-		cp: cp,
+		cp:       cp,
+		auth:     auth,
+		insecure: *insecure && *authConfig == "",
+		mtls:     *mtls,
 	}
 
-	//create handlers
+	//create handlers, every handler requires the role of a credential
 	r := http.NewServeMux()
-	r.HandleFunc("/upload", s.uploadHandler)
-	r.HandleFunc("/delete", s.deleteHandler)
-	r.HandleFunc("/scale", s.scaleHandler)
+	r.HandleFunc("/upload", s.require(controlplane.RoleDeploy, s.uploadHandler))
+	r.HandleFunc("/delete", s.require(controlplane.RoleDelete, s.deleteHandler))
+	r.HandleFunc("/scale", s.require(controlplane.RoleScale, s.scaleHandler))
+	r.HandleFunc("/scalein", s.require(controlplane.RoleScale, s.scaleInHandler))
+	r.HandleFunc("/secrets", s.require(controlplane.RoleDeploy, s.secretsHandler))
+	r.HandleFunc("GET /functions", s.require(controlplane.RoleRead, s.listHandler))
+	r.HandleFunc("GET /functions/{name}", s.require(controlplane.RoleRead, s.describeHandler))
+	r.HandleFunc("GET /functions/{name}/rollout", s.require(controlplane.RoleRead, s.rolloutHandler))
+	r.HandleFunc("GET /functions/{name}/versions", s.require(controlplane.RoleRead, s.versionsHandler))
+	r.HandleFunc("PUT /functions/{name}/aliases/{alias}", s.require(controlplane.RoleDeploy, s.setAliasHandler))
+	r.HandleFunc("DELETE /functions/{name}/aliases/{alias}", s.require(controlplane.RoleDeploy, s.deleteAliasHandler))
+	r.HandleFunc("PUT /functions/{name}/aliases/{alias}/canary", s.require(controlplane.RoleDeploy, s.setCanaryHandler))
+	r.HandleFunc("DELETE /functions/{name}/aliases/{alias}/canary", s.require(controlplane.RoleDeploy, s.deleteCanaryHandler))
+
+	addr := fmt.Sprintf(":%d", ConfigPort)
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+
+	if reloader != nil {
+		// client certificates are verified if presented, only /scale and /scalein require the one of the rproxy
+		var clientCA string
+		if *mtls {
+			clientCA = *ca
+		}
+
+		httpServer.TLSConfig, err = util.ServerTLS(reloader, clientCA)
+		if err != nil {
+			log.Printf("not able to load CA: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	// Shutdown-Hook
+	done := make(chan struct{})
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-sig
+		recv := <-sig
 
-		log.Printf("shutting down (received interrupt)")
+		log.Printf("shutting down (received %v)", recv)
+
+		// no more uploads, the rproxy can't scale anymore either
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		err := httpServer.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("shutting down HTTP-server failed with err: %v", err)
+		}
 
 		log.Printf("stopping rproxy")
-		err := rproxy.Kill()
+		ctx, cancel = context.WithTimeout(context.Background(), ShutdownTimeout)
+		err = stopRProxy(ctx, rproxy)
+		cancel()
 		if err != nil {
-			log.Printf("killing rproxy failed with err: %v", err)
+			log.Printf("stopping rproxy failed with err: %v", err)
 		}
+
 		err = s.cp.Stop()
 		if err != nil {
-			log.Printf("stopping controlplane failed with error: %v", err)
+			log.Printf("stopping controlplane failed, following resources were not cleaned up: %v", err)
 		}
-		os.Exit(0)
+
+		close(done)
 	}()
 
 	log.Printf("starting HTTP-server")
-	addr := fmt.Sprintf(":%d", ConfigPort)
-	err = http.ListenAndServe(addr, r)
-	if err != nil {
+	if httpServer.TLSConfig != nil {
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Printf("starting the server failed with error: %v", err)
+		return
+	}
+
+	<-done
+	log.Printf("controlplane stopped")
+}
+
+// stopRProxy asks the rproxy to drain its sessions and kills it if it does not exit before ctx is done
+func stopRProxy(ctx context.Context, rproxy *os.Process) error {
+	err := rproxy.Signal(syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		_, err := rproxy.Wait()
+		exited <- err
+	}()
+
+	select {
+	case err = <-exited:
+		return err
+	case <-ctx.Done():
+		log.Printf("rproxy did not exit in time, killing it")
+		return rproxy.Kill()
+	}
+}
+
+// loadAuth reads the credentials of the management API from a JSON file, no file means no credentials
+func loadAuth(path string, internalToken string) (*controlplane.Auth, error) {
+	var config controlplane.AuthConfig
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(b, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return controlplane.NewAuth(config, internalToken)
+}
+
+// require only passes on requests whose credential has the role
+func (s *server) require(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.insecure && role != controlplane.RoleScale {
+			next(w, req)
+			return
+		}
+
+		if s.mtls && role == controlplane.RoleScale && !util.HasClientCert(req.TLS) {
+			log.Printf("rejecting %s %s without a client certificate", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		name, err := s.auth.Authorize(req, role)
+		if errors.Is(err, controlplane.ErrForbidden) {
+			log.Printf("rejecting %s %s of %s: %v", req.Method, req.URL.Path, name, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("rejecting %s %s: %v", req.Method, req.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		log.Printf("%s %s by %s", req.Method, req.URL.Path, name)
+		next(w, req)
 	}
 }
 
@@ -162,8 +443,12 @@ func (s *server) uploadHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	d := struct {
-		FunctionName string `json:"name"`
-		FunctionZip  string `json:"zip"`
+		FunctionName string            `json:"name"`
+		FunctionZip  string            `json:"zip"`
+		Config       json.RawMessage   `json:"config"`
+		Secrets      map[string]string `json:"secrets"`
+		// Aliases are pointed to the new version in addition to the default alias
+		Aliases []string `json:"aliases"`
 	}{}
 
 	err := json.NewDecoder(req.Body).Decode(&d)
@@ -175,20 +460,304 @@ func (s *server) uploadHandler(w http.ResponseWriter, req *http.Request) {
 
 	log.Printf("received request to upload function: Name %s Bytes: %d", d.FunctionName, len(d.FunctionZip))
 
-	res, err := s.cp.Upload(d.FunctionName, d.FunctionZip)
-	if err != nil {
+	res, v, err := s.cp.Upload(d.FunctionName, d.FunctionZip, d.Config, d.Secrets, d.Aliases)
+	if errors.Is(err, controlplane.ErrShuttingDown) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, controlplane.ErrInvalidConfig) || errors.Is(err, controlplane.ErrInvalidName) {
+		log.Printf("config of function %s is not valid: %v", d.FunctionName, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	} else if err != nil {
 		log.Printf("Not able to upload function")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// the old deployment drains in the background, its progress can be followed here
+	w.Header().Set("Location", "/functions/"+url.PathEscape(d.FunctionName)+"/rollout")
+	w.Header().Set("X-Aube-Version", strconv.Itoa(v.Number))
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, res)
 }
 
 func (s *server) deleteHandler(w http.ResponseWriter, req *http.Request) {
-	// Will add functionality later
-	w.WriteHeader(http.StatusNotImplemented)
+	log.Printf("received delete request")
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d := struct {
+		FunctionName string `json:"name"`
+		Force        bool   `json:"force"`
+	}{}
+
+	err := json.NewDecoder(req.Body).Decode(&d)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("could not decode request: %v", err)
+		return
+	}
+
+	err = s.cp.Delete(d.FunctionName, d.Force)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		log.Printf("handler with name: %s not found", d.FunctionName)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, controlplane.ErrFunctionBusy) {
+		log.Printf("function %s still has active sessions", d.FunctionName)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("not able to delete function %s: %v", d.FunctionName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "deleted %s\n", d.FunctionName)
+}
+
+func (s *server) secretsHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("received secrets request")
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// never log this struct, it contains the values of the secrets
+	d := struct {
+		FunctionName string             `json:"name"`
+		Secrets      map[string]*string `json:"secrets"`
+	}{}
+
+	err := json.NewDecoder(req.Body).Decode(&d)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("could not decode request: %v", err)
+		return
+	}
+
+	names, err := s.cp.SetSecrets(d.FunctionName, d.Secrets)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		log.Printf("handler with name: %s not found", d.FunctionName)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, controlplane.ErrInvalidConfig) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	} else if err != nil {
+		log.Printf("not able to update secrets of function %s: %v", d.FunctionName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	r := struct {
+		Secrets []string `json:"secrets"`
+	}{
+		Secrets: names,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
+}
+
+func (s *server) listHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("received list request")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.cp.List()); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
+}
+
+func (s *server) describeHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	log.Printf("received describe request for function: %s", name)
+
+	d, err := s.cp.Describe(name)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		log.Printf("handler with name: %s not found", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
+}
+
+func (s *server) rolloutHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	log.Printf("received rollout request for function: %s", name)
+
+	r, err := s.cp.Rollout(name)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
+}
+
+func (s *server) versionsHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	log.Printf("received versions request for function: %s", name)
+
+	h, err := s.cp.Versions(name)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
+}
+
+// setAliasHandler points an alias to an existing version, which is how a function is rolled back
+func (s *server) setAliasHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	alias := req.PathValue("alias")
+	log.Printf("received request to set alias %s of function: %s", alias, name)
+
+	d := struct {
+		Version int `json:"version"`
+	}{}
+
+	err := json.NewDecoder(req.Body).Decode(&d)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("could not decode request: %v", err)
+		return
+	}
+
+	err = s.cp.SetAlias(name, alias, d.Version)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) || errors.Is(err, controlplane.ErrVersionNotFound) {
+		log.Printf("version %d of function %s not found", d.Version, name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, controlplane.ErrVersionPruned) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, err)
+		return
+	} else if errors.Is(err, controlplane.ErrInvalidName) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	} else if errors.Is(err, controlplane.ErrShuttingDown) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("not able to set alias %s of function %s: %v", alias, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/functions/"+url.PathEscape(name)+"/rollout")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s of %s points to version %d\n", alias, name, d.Version)
+}
+
+func (s *server) deleteAliasHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	alias := req.PathValue("alias")
+	log.Printf("received request to delete alias %s of function: %s", alias, name)
+
+	err := s.cp.DeleteAlias(name, alias)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, controlplane.ErrInvalidName) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	} else if err != nil {
+		log.Printf("not able to delete alias %s of function %s: %v", alias, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "deleted alias %s of %s\n", alias, name)
+}
+
+// setCanaryHandler sends a share of the sessions of an alias to another version
+func (s *server) setCanaryHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	alias := req.PathValue("alias")
+	log.Printf("received request to set the canary of alias %s of function: %s", alias, name)
+
+	var canary controlplane.Canary
+	err := json.NewDecoder(req.Body).Decode(&canary)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("could not decode request: %v", err)
+		return
+	}
+
+	err = s.cp.SetCanary(name, alias, canary)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) || errors.Is(err, controlplane.ErrVersionNotFound) {
+		log.Printf("alias %s or version %d of function %s not found", alias, canary.Version, name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, controlplane.ErrVersionPruned) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, err)
+		return
+	} else if errors.Is(err, controlplane.ErrInvalidConfig) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	} else if errors.Is(err, controlplane.ErrShuttingDown) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("not able to set the canary of alias %s of function %s: %v", alias, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d%% of %s of %s go to version %d\n", canary.Weight, alias, name, canary.Version)
+}
+
+func (s *server) deleteCanaryHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	alias := req.PathValue("alias")
+	log.Printf("received request to delete the canary of alias %s of function: %s", alias, name)
+
+	err := s.cp.DeleteCanary(name, alias)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("not able to delete the canary of alias %s of function %s: %v", alias, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "deleted the canary of %s of %s\n", alias, name)
 }
 
 func (s *server) scaleHandler(w http.ResponseWriter, req *http.Request) {
@@ -213,11 +782,22 @@ func (s *server) scaleHandler(w http.ResponseWriter, req *http.Request) {
 	log.Printf("decoded req.Body to: %v", d)
 
 	ips, err := s.cp.Scale(d.FunctionName, d.Amount)
-	if err != nil && errors.Is(err, http.ErrMissingFile) {
+	if err != nil && len(ips) > 0 {
+		// a partial scale-out still has to reach the rproxy, otherwise the containers are never used
+		log.Printf("scaled function %s by %d of %d containers: %v", d.FunctionName, len(ips), d.Amount, err)
+	} else if err != nil && errors.Is(err, controlplane.ErrFunctionNotFound) {
 		log.Printf("handler with name: %s not found", d.FunctionName)
 		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, controlplane.ErrShuttingDown) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, controlplane.ErrMaxThreads) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
 	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	log.Printf("after calling Scale have following ips: %v", ips)
@@ -236,3 +816,35 @@ func (s *server) scaleHandler(w http.ResponseWriter, req *http.Request) {
 		log.Printf("failed to encode response: %v", err)
 	}
 }
+
+func (s *server) scaleInHandler(w http.ResponseWriter, req *http.Request) {
+	log.Printf("received req to scale in function")
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d := struct {
+		FunctionName string   `json:"name"`
+		IPs          []string `json:"ips"`
+	}{}
+
+	err := json.NewDecoder(req.Body).Decode(&d)
+	if err != nil {
+		log.Printf("not able to correctly decode the body of the message")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = s.cp.ScaleIn(d.FunctionName, d.IPs)
+	if errors.Is(err, controlplane.ErrFunctionNotFound) {
+		log.Printf("handler with name: %s not found", d.FunctionName)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,8 @@
+//go:build !(darwin && arm64)
+// +build !darwin !arm64
+
+package main
+
+// RProxyBin is only embedded for the supported platforms (see SUPPORTED_ARCH in the Makefile),
+// on other ones the control plane does not start
+var RProxyBin []byte
@@ -2,10 +2,19 @@ package main
 
 import (
 	"aube/pkg/rproxy"
-	"bytes"
+	"aube/pkg/util"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -17,69 +26,249 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.SetPrefix("rproxy: ")
 
-	proxy := rproxy.New()
+	idleTTL := flag.Duration("idle-ttl", 15*time.Minute, "time after which an unused container is shut down")
+	minWarm := flag.Int("min-warm", 1, "minimum amount of containers kept per function, 0 allows scaling to zero")
+	drainTimeout := flag.Duration("drain-timeout", 20*time.Second, "time active sessions get to finish on shutdown")
+	defaults := rproxy.DefaultSettings()
+	flag.IntVar(&defaults.QueueSize, "queue-size", defaults.QueueSize, "maximum amount of sessions waiting for a free container per function")
+	flag.DurationVar(&defaults.QueueTimeout, "queue-timeout", defaults.QueueTimeout, "time a session waits for a free container")
+	flag.IntVar(&defaults.Headroom, "headroom", defaults.Headroom, "amount of free containers kept ahead of new sessions per function")
+	flag.IntVar(&defaults.MaxBatch, "max-batch", defaults.MaxBatch, "maximum amount of containers requested by a single scale-out")
+	flag.DurationVar(&defaults.RateWindow, "rate-window", defaults.RateWindow, "time window of the observed session arrival rate")
+	flag.IntVar(&defaults.DialAttempts, "dial-attempts", defaults.DialAttempts, "maximum amount of containers a session tries to connect to")
+	flag.DurationVar(&defaults.DialDeadline, "dial-deadline", defaults.DialDeadline, "time a session may spend connecting to containers, including retries")
+	flag.DurationVar(&defaults.Quarantine, "quarantine", defaults.Quarantine, "time a container is out of rotation after a failed connection")
+	flag.IntVar(&defaults.BreakerThreshold, "breaker-threshold", defaults.BreakerThreshold, "failed connections in a row which open the circuit breaker of a container")
+	flag.DurationVar(&defaults.BreakerCooldown, "breaker-cooldown", defaults.BreakerCooldown, "time a container with an open circuit breaker is out of rotation")
+	flag.StringVar(&defaults.Strategy, "strategy", defaults.Strategy, "selection strategy of the container of a session: random, lru, mru or hash")
+	flag.StringVar(&defaults.ClientKey, "client-key", defaults.ClientKey, "header or query parameter identifying a client for the hash strategy")
+	flag.DurationVar(&defaults.ResumeGrace, "resume-grace", defaults.ResumeGrace, "time the container of an ended session is reserved for the client to resume it, 0 disables session tokens")
+	flag.StringVar(&defaults.Relay, "relay", defaults.Relay, "how sessions are relayed: raw copies the bytes, frames relays message by message")
+	flag.DurationVar(&defaults.IdleTimeout, "idle-timeout", defaults.IdleTimeout, "time a session may go without messages, 0 disables it")
+	flag.DurationVar(&defaults.WriteTimeout, "write-timeout", defaults.WriteTimeout, "time a side of a session gets to take a message, 0 disables it")
+	flag.DurationVar(&defaults.MaxDuration, "max-duration", defaults.MaxDuration, "maximum duration of a session, 0 disables it")
+	flag.Int64Var(&defaults.MaxMessageSize, "max-message-size", defaults.MaxMessageSize, "maximum size of a message in bytes, 0 disables it")
+	flag.Int64Var(&defaults.MaxBytes, "max-bytes", defaults.MaxBytes, "maximum payload of all messages of a session in bytes, 0 disables it")
+	authConfig := flag.String("auth-config", "", "auth config (JSON file) with the API keys and JWT keys of the user endpoint, sessions are not authenticated if empty")
+	origins := flag.String("origins", "", "comma separated browser origins which may open sessions, every origin if empty")
+	controlPlaneAddr := flag.String("control-plane", rproxy.ControlPlaneAddr, "address of the internal endpoints of the control plane")
+	tlsCert := flag.String("tls-cert", "", "certificate (PEM file) of the user and the config endpoint, which serve TLS if set")
+	tlsKey := flag.String("tls-key", "", "key (PEM file) of the certificate")
+	ca := flag.String("ca", "", "CA (PEM file) verifying the control plane and, with -mtls, its client certificate")
+	mtls := flag.Bool("mtls", false, "require the client certificate of the control plane on the config endpoint and present -tls-cert to it")
+	flag.Parse()
+
+	err := defaults.Validate()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	proxy := rproxy.New(defaults)
+
+	// the control plane passes its internal credential, the proxy uses it for /scale and requires it on the config endpoint
+	internalToken := os.Getenv(rproxy.InternalTokenEnv)
+	proxy.SetInternalToken(internalToken)
+	if *origins != "" {
+		proxy.AllowOrigins(strings.Split(*origins, ","))
+	}
+
+	// the files are checked for renewed certificates on new connections
+	var reloader *util.CertReloader
+	if *tlsCert != "" {
+		reloader, err = util.NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("not able to load certificate: %v", err)
+		}
+	} else if *mtls {
+		log.Fatalf("-mtls requires -tls-cert and -tls-key")
+	}
+
+	var clientCert *util.CertReloader
+	if *mtls {
+		clientCert = reloader
+	}
+	clientTLS, err := util.ClientTLS(*ca, clientCert)
+	if err != nil {
+		log.Fatalf("not able to load CA: %v", err)
+	}
+	proxy.SetControlPlane(*controlPlaneAddr, &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}})
+
+	if *authConfig != "" {
+		auth, err := loadAuth(*authConfig)
+		if err != nil {
+			log.Fatalf("not able to load auth config: %v", err)
+		}
+		proxy.SetAuthenticator(auth)
+	}
+
+	proxy.StartReaper(*idleTTL, *minWarm)
 
 	// Need a Config-Endpoint Server on Port :8091
 
 	configServer := http.NewServeMux()
 
-	configServer.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		log.Printf("reiceved req: %v", req)
-		if req.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+	configServer.HandleFunc("GET /metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := proxy.WriteMetrics(w); err != nil {
+			log.Printf("failed to write metrics: %v", err)
 		}
+	})
 
-		b := new(bytes.Buffer)
-		_, err := b.ReadFrom(req.Body)
-		if err != nil {
+	// registry of all functions
+	configServer.HandleFunc("GET /{$}", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, proxy.Status())
+	})
+
+	// deprecated: the registration of the earlier control planes, non-empty ips set the containers of the
+	// function, empty ips remove it. PUT and DELETE /functions/{name} replace it.
+	configServer.HandleFunc("POST /{$}", func(w http.ResponseWriter, req *http.Request) {
+		d := struct {
+			Name string   `json:"name"`
+			IPs  []string `json:"ips"`
+		}{}
+
+		err := json.NewDecoder(req.Body).Decode(&d)
+		name := strings.TrimPrefix(d.Name, "/")
+		if err != nil || name == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		str := b.String()
 
+		log.Printf("received a deprecated registration of function %s, use PUT or DELETE /functions/%s", name, name)
+
+		if len(d.IPs) == 0 {
+			err = proxy.Del(name, false)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		proxy.Register(name, "", d.IPs)
+		writeFunction(w, proxy, name, nil)
+	})
+
+	configServer.HandleFunc("GET /functions/{name}", func(w http.ResponseWriter, req *http.Request) {
+		writeFunction(w, proxy, req.PathValue("name"), nil)
+	})
+
+	// sets the containers of a function, the function is added if it does not exist yet.
+	// A deployment names the function it belongs to, the credentials of that function apply to its sessions
+	configServer.HandleFunc("PUT /functions/{name}", func(w http.ResponseWriter, req *http.Request) {
 		d := struct {
-			FunctionName string   `json:"name"`
-			FunctionIPs  []string `json:"ips"`
+			IPs      []string `json:"ips"`
+			Function string   `json:"function"`
 		}{}
 
-		err = json.Unmarshal([]byte(str), &d)
+		err := json.NewDecoder(req.Body).Decode(&d)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 
-		if d.FunctionName[0] == '/' {
-			d.FunctionName = d.FunctionName[1:]
+		name := req.PathValue("name")
+		proxy.Register(name, d.Function, d.IPs)
+		writeFunction(w, proxy, name, nil)
+	})
+
+	configServer.HandleFunc("DELETE /functions/{name}", func(w http.ResponseWriter, req *http.Request) {
+		force := req.URL.Query().Get("force") == "true"
+
+		err := proxy.Del(req.PathValue("name"), force)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
+		w.WriteHeader(http.StatusOK)
+	})
 
-		if len(d.FunctionIPs) > 0 {
-			log.Printf("received req, now adding function")
-			err = proxy.Add(d.FunctionName, d.FunctionIPs)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			log.Printf("current registry of the proxy: %v", proxy.GetHosts())
-			w.WriteHeader(http.StatusOK)
+	configServer.HandleFunc("POST /functions/{name}/endpoints", func(w http.ResponseWriter, req *http.Request) {
+		ips, err := decodeIPs(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			return
-		} else {
-			err = proxy.Del(d.FunctionName)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+		}
+
+		name := req.PathValue("name")
+		writeFunction(w, proxy, name, proxy.AddEndpoints(name, ips))
+	})
+
+	configServer.HandleFunc("DELETE /functions/{name}/endpoints", func(w http.ResponseWriter, req *http.Request) {
+		ips, err := decodeIPs(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
+		name := req.PathValue("name")
+		writeFunction(w, proxy, name, proxy.RemoveEndpoints(name, ips))
 	})
 
-	go func() {
-		err := http.ListenAndServe(ConfigAddr, configServer)
+	// applies the given fields on top of the current settings of the function
+	configServer.HandleFunc("PATCH /functions/{name}/settings", func(w http.ResponseWriter, req *http.Request) {
+		name := req.PathValue("name")
+
+		settings, err := proxy.Settings(name)
 		if err != nil {
-			log.Fatalf("error listening to config")
+			writeError(w, err)
+			return
 		}
-	}()
+
+		err = json.NewDecoder(req.Body).Decode(&settings)
+		if err != nil {
+			log.Printf("not able to decode settings of function %s: %v", name, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		writeFunction(w, proxy, name, proxy.SetSettings(name, settings))
+	})
+
+	configServer.HandleFunc("GET /routes", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, proxy.Routes())
+	})
+
+	// routes new sessions on the path to weighted functions, e.g. an alias to the deployments of its versions.
+	// {"backend": "<name>"} is short for a single backend
+	configServer.HandleFunc("PUT /routes/{route...}", func(w http.ResponseWriter, req *http.Request) {
+		d := struct {
+			rproxy.Route
+			Backend string `json:"backend"`
+		}{}
+
+		err := json.NewDecoder(req.Body).Decode(&d)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if d.Backend != "" {
+			d.Backends = append(d.Backends, rproxy.WeightedBackend{Backend: d.Backend, Weight: 1})
+		}
+
+		err = proxy.SetRoute(req.PathValue("route"), d.Route)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	configServer.HandleFunc("DELETE /routes/{route...}", func(w http.ResponseWriter, req *http.Request) {
+		err := proxy.DelRoute(req.PathValue("route"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfgServer := &http.Server{
+		Addr:    ConfigAddr,
+		Handler: protect(internalToken, *mtls, configServer),
+	}
 
 	// User Endpoint
 	server := &http.Server{
@@ -87,9 +276,164 @@ func main() {
 		Handler: proxy,
 	}
 
+	if reloader != nil {
+		server.TLSConfig, err = util.ServerTLS(reloader, "")
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		var clientCA string
+		if *mtls {
+			clientCA = *ca
+		}
+		cfgServer.TLSConfig, err = util.ServerTLS(reloader, clientCA)
+		if err != nil {
+			log.Fatalf("not able to load CA: %v", err)
+		}
+	}
+
+	go func() {
+		err := listen(cfgServer)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("error listening to config")
+		}
+	}()
+
+	// Shutdown-Hook
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("shutting down (received %v), draining sessions for up to %v", s, *drainTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+
+		// hijacked connections are not tracked by the server, so the proxy drains them itself
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("shutting down user endpoint failed with err: %v", err)
+		}
+
+		err = proxy.Shutdown(ctx)
+		if err != nil {
+			log.Printf("draining sessions failed with err: %v", err)
+		}
+
+		err = cfgServer.Shutdown(ctx)
+		if err != nil {
+			log.Printf("shutting down config endpoint failed with err: %v", err)
+		}
+
+		close(done)
+	}()
+
 	log.Printf("started on addr: %s", server.Addr)
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := listen(server); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed: %v", err)
 	}
+
+	<-done
+	log.Printf("stopped")
+}
+
+// listen serves TLS if the server has a TLS config, the certificate comes from the config
+func listen(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// protect only passes on requests with the bearer token and, with mtls, a verified client certificate.
+// An empty token passes on every request.
+func protect(token string, mtls bool, next http.Handler) http.Handler {
+	if token == "" {
+		log.Printf("no internal credential, the config endpoint is not protected")
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if mtls && !util.HasClientCert(req.TLS) {
+			log.Printf("rejecting config request %s %s without a client certificate", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		bearer, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			log.Printf("rejecting unauthenticated config request %s %s", req.Method, req.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// loadAuth reads the auth config of the user endpoint from a JSON file
+func loadAuth(path string) (*rproxy.Auth, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config rproxy.AuthConfig
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return rproxy.NewAuth(config)
+}
+
+// decodeIPs reads the {"ips": [...]} body of an endpoints request
+func decodeIPs(req *http.Request) ([]string, error) {
+	d := struct {
+		IPs []string `json:"ips"`
+	}{}
+
+	err := json.NewDecoder(req.Body).Decode(&d)
+	return d.IPs, err
+}
+
+// writeFunction answers a request with the current state of the function, unless err is set
+func writeFunction(w http.ResponseWriter, proxy *rproxy.RProxy, name string, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status, err := proxy.FunctionStatus(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, status)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	log.Printf("config request failed with err: %v", err)
+
+	switch {
+	case errors.Is(err, rproxy.ErrFunctionNotFound), errors.Is(err, rproxy.ErrRouteNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, rproxy.ErrFunctionInUse):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, rproxy.ErrInvalidSettings), errors.Is(err, rproxy.ErrInvalidRoute):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
 }
@@ -0,0 +1,117 @@
+package controlplane
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Roles of the management API, a credential may have several of them
+const (
+	// RoleRead lists and describes functions, their versions and rollouts
+	RoleRead = "read"
+	// RoleDeploy uploads functions and sets their secrets, aliases and canaries
+	RoleDeploy = "deploy"
+	// RoleDelete deletes functions
+	RoleDelete = "delete"
+	// RoleScale adds and removes containers through /scale and /scalein, it is the role of the rproxy
+	RoleScale = "scale"
+	// RoleAdmin may do everything
+	RoleAdmin = "admin"
+)
+
+// Roles are all roles of the management API
+var Roles = []string{RoleRead, RoleDeploy, RoleDelete, RoleScale, RoleAdmin}
+
+const (
+	// InternalPrincipal is the name of the internal credential of the rproxy
+	InternalPrincipal = "rproxy"
+)
+
+var (
+	// ErrUnauthorized is returned if a request has no or an unknown credential
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned if the credential of a request lacks the role
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalidAuthConfig is returned if the auth config can't be used
+	ErrInvalidAuthConfig = errors.New("invalid auth config")
+)
+
+// Credential is a bearer token of the management API and the roles it grants
+type Credential struct {
+	Token string   `json:"token"`
+	Roles []string `json:"roles"`
+}
+
+// AuthConfig are the credentials of the management API by the name of their holder
+type AuthConfig struct {
+	Credentials map[string]Credential `json:"credentials"`
+}
+
+// Auth authorizes the requests of the management API
+type Auth struct {
+	credentials map[string]Credential
+}
+
+// NewAuth checks the credentials of the config, the internal token is added as the credential of the rproxy
+func NewAuth(config AuthConfig, internalToken string) (*Auth, error) {
+	credentials := make(map[string]Credential, len(config.Credentials)+1)
+
+	for name, c := range config.Credentials {
+		if name == "" || name == InternalPrincipal {
+			return nil, fmt.Errorf("%w: %q can't be the name of a credential", ErrInvalidAuthConfig, name)
+		}
+
+		if c.Token == "" {
+			return nil, fmt.Errorf("%w: credential %s has no token", ErrInvalidAuthConfig, name)
+		}
+
+		for _, role := range c.Roles {
+			if !slices.Contains(Roles, role) {
+				return nil, fmt.Errorf("%w: unknown role %q of credential %s", ErrInvalidAuthConfig, role, name)
+			}
+		}
+
+		credentials[name] = c
+	}
+
+	if internalToken != "" {
+		credentials[InternalPrincipal] = Credential{Token: internalToken, Roles: []string{RoleScale}}
+	}
+
+	return &Auth{credentials: credentials}, nil
+}
+
+// Authorize returns the name of the holder of the bearer token of the request, if it has the role
+func (a *Auth) Authorize(req *http.Request, role string) (string, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", fmt.Errorf("%w: no bearer token", ErrUnauthorized)
+	}
+
+	for name, c := range a.credentials {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+			continue
+		}
+
+		if !slices.Contains(c.Roles, role) && !slices.Contains(c.Roles, RoleAdmin) {
+			return name, fmt.Errorf("%w: %s lacks the role %s", ErrForbidden, name, role)
+		}
+
+		return name, nil
+	}
+
+	return "", fmt.Errorf("%w: unknown token", ErrUnauthorized)
+}
+
+// NewToken returns a random token, e.g. the internal credential of the rproxy
+func NewToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,204 @@
+package controlplane
+
+import (
+	"aube/pkg/rproxy"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// ManifestFile is the optional deployment configuration in the root of a function zip
+	ManifestFile = "aube.json"
+	// MaxThreadsLimit is the upper bound for the maxThreads of a single function
+	MaxThreadsLimit = 100
+	DefaultRuntime  = "python"
+	// DefaultEntrypoint is <module>:<function> of the function which handles a stream
+	DefaultEntrypoint = "fn:fn"
+)
+
+// ErrInvalidConfig is returned if the deployment configuration of a function is not valid
+var ErrInvalidConfig = errors.New("invalid function config")
+
+// FunctionConfig is the deployment configuration of a function
+type FunctionConfig struct {
+	InitThreads int               `json:"initThreads"`
+	MaxThreads  int               `json:"maxThreads"`
+	Runtime     string            `json:"runtime"`
+	Env         map[string]string `json:"env,omitempty"`
+	Entrypoint  string            `json:"entrypoint"`
+	Resources   Resources         `json:"resources"`
+	// Trusted opts out of the hardened container profile. It is granted by the operator (ControlPlane.Trusted)
+	// when a version is deployed, uploaded configs can't set it.
+	Trusted bool `json:"trusted,omitempty"`
+	// Strategy selects the container of a session in the rproxy: random, lru, mru or hash. Empty keeps the rproxy default
+	Strategy string `json:"strategy,omitempty"`
+	// ClientKey is the header or query parameter identifying a client for the hash strategy
+	ClientKey string `json:"clientKey,omitempty"`
+	// ResumeGrace is how long the rproxy reserves the container of a session for the client to resume it, e.g. "30s"
+	ResumeGrace string `json:"resumeGrace,omitempty"`
+	// Relay is rproxy.RelayRaw or rproxy.RelayFrames, with frames the rproxy relays the sessions of the function message by message
+	Relay string `json:"relay,omitempty"`
+	// Limits of the sessions of the function, enforced by the rproxy
+	Limits SessionLimits `json:"limits"`
+}
+
+// SessionLimits close the sessions of a function in the rproxy, zero values keep the defaults of the rproxy
+type SessionLimits struct {
+	// IdleTimeout, WriteTimeout and MaxDuration are durations like "5m"
+	IdleTimeout    string `json:"idleTimeout,omitempty"`
+	WriteTimeout   string `json:"writeTimeout,omitempty"`
+	MaxDuration    string `json:"maxDuration,omitempty"`
+	MaxMessageSize int64  `json:"maxMessageSize,omitempty"`
+	MaxBytes       int64  `json:"maxBytes,omitempty"`
+}
+
+// Resources limits what a single container of a function may use, zero means unlimited
+type Resources struct {
+	CPUs      float64 `json:"cpus"`
+	CPUShares int64   `json:"cpuShares"`
+	MemoryMB  int64   `json:"memoryMB"`
+	// MemorySwapMB is memory plus swap, -1 allows unlimited swap and 0 uses the docker default (twice the memory)
+	MemorySwapMB int64    `json:"memorySwapMB"`
+	Pids         int64    `json:"pids"`
+	Ulimits      []Ulimit `json:"ulimits,omitempty"`
+}
+
+// Ulimit is a ulimit (e.g. nofile) of the containers of a function
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+func DefaultConfig() FunctionConfig {
+	return FunctionConfig{
+		InitThreads: DefaultInitThreads,
+		MaxThreads:  DefaultMaxThreads,
+		Runtime:     DefaultRuntime,
+		Entrypoint:  DefaultEntrypoint,
+	}
+}
+
+// ParseConfig applies the given JSON documents on top of the default config, later ones
+// override the fields set by earlier ones. Empty documents are skipped, "trusted" is ignored.
+func ParseConfig(docs ...[]byte) (FunctionConfig, error) {
+	c := DefaultConfig()
+
+	for _, doc := range docs {
+		if len(doc) == 0 {
+			continue
+		}
+
+		err := json.Unmarshal(doc, &c)
+		if err != nil {
+			return FunctionConfig{}, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	// the documents come from the uploader, only the operator may trust a function
+	c.Trusted = false
+
+	return c, c.Validate()
+}
+
+// Validate checks the config for values the backend can't work with
+func (c FunctionConfig) Validate() error {
+	if c.MaxThreads < 1 || c.MaxThreads > MaxThreadsLimit {
+		return fmt.Errorf("%w: maxThreads must be between 1 and %d, is %d", ErrInvalidConfig, MaxThreadsLimit, c.MaxThreads)
+	}
+
+	if c.InitThreads < 0 || c.InitThreads > c.MaxThreads {
+		return fmt.Errorf("%w: initThreads must be between 0 and maxThreads (%d), is %d", ErrInvalidConfig, c.MaxThreads, c.InitThreads)
+	}
+
+	if c.Runtime == "" {
+		return fmt.Errorf("%w: runtime must not be empty", ErrInvalidConfig)
+	}
+
+	module, function, ok := strings.Cut(c.Entrypoint, ":")
+	if !ok || module == "" || function == "" {
+		return fmt.Errorf("%w: entrypoint must be <module>:<function>, is %q", ErrInvalidConfig, c.Entrypoint)
+	}
+
+	if c.Strategy != "" && !slices.Contains(rproxy.Strategies, c.Strategy) {
+		return fmt.Errorf("%w: strategy must be one of %v, is %q", ErrInvalidConfig, rproxy.Strategies, c.Strategy)
+	}
+
+	if c.Strategy == rproxy.StrategyHash && c.ClientKey == "" {
+		return fmt.Errorf("%w: strategy hash needs a clientKey", ErrInvalidConfig)
+	}
+
+	if c.ResumeGrace != "" {
+		grace, err := time.ParseDuration(c.ResumeGrace)
+		if err != nil || grace < 0 {
+			return fmt.Errorf("%w: resumeGrace must be a duration like \"30s\", is %q", ErrInvalidConfig, c.ResumeGrace)
+		}
+	}
+
+	if c.Relay != "" && c.Relay != rproxy.RelayRaw && c.Relay != rproxy.RelayFrames {
+		return fmt.Errorf("%w: relay must be %q or %q, is %q", ErrInvalidConfig, rproxy.RelayRaw, rproxy.RelayFrames, c.Relay)
+	}
+
+	for k := range c.Env {
+		if !validEnvName(k) {
+			return fmt.Errorf("%w: invalid environment variable name %q", ErrInvalidConfig, k)
+		}
+	}
+
+	err := c.Limits.validate()
+	if err != nil {
+		return err
+	}
+
+	return c.Resources.validate()
+}
+
+func (l SessionLimits) validate() error {
+	for name, d := range map[string]string{"idleTimeout": l.IdleTimeout, "writeTimeout": l.WriteTimeout, "maxDuration": l.MaxDuration} {
+		if d == "" {
+			continue
+		}
+
+		v, err := time.ParseDuration(d)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%w: %s must be a duration like \"5m\", is %q", ErrInvalidConfig, name, d)
+		}
+	}
+
+	if l.MaxMessageSize < 0 || l.MaxBytes < 0 {
+		return fmt.Errorf("%w: maxMessageSize and maxBytes must not be negative", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+func (r Resources) validate() error {
+	if r.CPUs < 0 || r.CPUShares < 0 || r.MemoryMB < 0 || r.Pids < 0 {
+		return fmt.Errorf("%w: resource limits must not be negative", ErrInvalidConfig)
+	}
+
+	if r.MemorySwapMB != 0 && r.MemoryMB == 0 {
+		return fmt.Errorf("%w: memorySwapMB requires memoryMB", ErrInvalidConfig)
+	}
+
+	if r.MemorySwapMB != 0 && r.MemorySwapMB != -1 && r.MemorySwapMB < r.MemoryMB {
+		return fmt.Errorf("%w: memorySwapMB must be -1 or at least memoryMB (%d), is %d", ErrInvalidConfig, r.MemoryMB, r.MemorySwapMB)
+	}
+
+	for _, u := range r.Ulimits {
+		if u.Name == "" || u.Soft < 0 || u.Soft > u.Hard {
+			return fmt.Errorf("%w: invalid ulimit %+v", ErrInvalidConfig, u)
+		}
+	}
+
+	return nil
+}
+
+// validEnvName reports whether k can be used as the name of an environment variable in a container
+func validEnvName(k string) bool {
+	return k != "" && !strings.ContainsAny(k, "= ")
+}
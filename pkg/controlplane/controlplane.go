@@ -2,77 +2,438 @@ package controlplane
 
 import (
 	"aube/pkg/util"
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	uuid2 "github.com/google/uuid"
 )
 
 const (
 	TmpDir = "./tmp"
+	// DestroyTimeout is the deadline for destroying all functions on shutdown
+	DestroyTimeout = 30 * time.Second
+	// DefaultInitThreads and DefaultMaxThreads are used if nothing else is known about a function
+	DefaultInitThreads = 1
+	DefaultMaxThreads  = 10
+	// RProxyRetries is the amount of attempts to reach the rproxy while it is still starting
+	RProxyRetries = 10
+)
+
+// ReconcilePolicy determines what happens on startup with resources of this instance which are not in its store
+type ReconcilePolicy string
+
+const (
+	// ReconcileNone only logs orphaned resources
+	ReconcileNone ReconcilePolicy = "none"
+	// ReconcileRemove garbage-collects orphaned resources
+	ReconcileRemove ReconcilePolicy = "remove"
+	// ReconcileAdopt takes over orphaned functions with running containers and removes everything else
+	ReconcileAdopt ReconcilePolicy = "adopt"
+)
+
+var (
+	// ErrFunctionNotFound is returned if no handler is registered for the given function name
+	ErrFunctionNotFound = errors.New("function not found")
+	// ErrFunctionBusy is returned if the function still serves sessions and the operation was not forced
+	ErrFunctionBusy = errors.New("function has active sessions")
+	// ErrShuttingDown is returned for uploads and scale requests once Stop was called
+	ErrShuttingDown = errors.New("control plane is shutting down")
+	// ErrMaxThreads is returned if a function already runs maxThreads containers
+	ErrMaxThreads = errors.New("function reached its maxThreads")
 )
 
 type ControlPlane struct {
-	id                 string
-	FunctionHandlers   map[string]Handler
+	id string
+	// FunctionHandlers are the active deployments of all functions by their uniqueName
+	FunctionHandlers map[string]Handler
+	// functionHandlerMtx guards FunctionHandlers and functionLocks, it is only held briefly and never during
+	// slow work like starting containers or calling the rproxy, so the functions don't block each other
 	functionHandlerMtx sync.Mutex
-	rproxyListenAddr   string
-	rproxyConfigPort   int
-	backend            Backend
+	// functionLocks serialize the changes to the versions, aliases, secrets and deployments of a function by its name
+	functionLocks    map[string]*sync.Mutex
+	rproxyListenAddr string
+	rproxyConfigPort int
+	backend          Backend
+	store            Store
+	stopping         atomic.Bool
+	stopWatching     context.CancelFunc
+	exits            map[string][]ContainerExit
+	exitsMtx         sync.Mutex
+	// DrainGrace is how long a replaced deployment may serve its sessions before it is destroyed
+	DrainGrace time.Duration
+	// ImageRetention is the amount of the newest versions of a function without an alias whose images are kept
+	ImageRetention int
+	rollouts       rollouts
+	// HealthInterval is the interval in which MonitorHealth probes the containers
+	HealthInterval time.Duration
+	health         map[string]*deploymentHealth
+	healthMtx      sync.Mutex
+	stopMonitoring context.CancelFunc
+	// replacements waits for the containers replenish is starting
+	replacements sync.WaitGroup
+	// Trusted are the names of the functions whose containers run without the hardened profile
+	Trusted []string
+	// RProxyToken is the internal credential the rproxy requires on its config endpoint
+	RProxyToken string
+	// rproxyClient calls the config endpoint of the rproxy, which serves TLS if rproxyTLS is set
+	rproxyClient *http.Client
+	rproxyTLS    bool
 }
 
 // Backend has only the Docker implementation
 type Backend interface {
-	// Create creates a function in the Backend -> used by the upload script
-	Create(name string, filedir string, initThreads int, maxThreads int) (Handler, error)
+	// Build builds the image of a new version of a function from filedir and returns the image name
+	Build(name string, filedir string, config FunctionConfig) (string, error)
+	// Deploy creates a new deployment of a version, secrets are injected like environment variables,
+	// but are never part of the FunctionState
+	Deploy(name string, version Version, secrets map[string]string) (Handler, error)
+	// RemoveImage removes the image of a version which is not deployed anymore
+	RemoveImage(image string) error
+	// Reconcile finds resources of this instance which are not known, i.e. not in the given set of function names,
+	// uniqueNames and images, and removes or adopts them depending on the policy. Adopted functions are returned by their name
+	Reconcile(policy ReconcilePolicy, known map[string]bool) (map[string]Handler, error)
+	// Restore rebuilds the handler of a function from its persisted state
+	Restore(state FunctionState, secrets map[string]string) (Handler, error)
+	// Watch reports every container which dies without being stopped by a Handler, until ctx is done
+	Watch(ctx context.Context, report func(ContainerExit))
 	Stop() error
 }
 
 // Handler is a 'generic' interface for all different Backend (only have Docker for now)
 type Handler interface {
 	IPs() []string
-	// StartContainer will be triggered after Add was invoked successfully
-	StartContainer(name string) error
+	// StartContainer will be triggered after Add was invoked successfully, it returns the ip of the started container
+	StartContainer(name string) (string, error)
 	// Start will be triggered right after creation of the initial containers
 	Start() error
+	// Add creates a single container and returns its id, which is passed to StartContainer
 	Add() (string, error)
 	Delete(name string) error
+	// Destroy removes the containers and the network of the deployment, the image of the version is kept
 	Destroy() error
 	Logs() (io.Reader, error)
+	// State returns the metadata which is persisted in the Store
+	State() FunctionState
+	// SetSecrets replaces the secrets which are injected into new containers
+	SetSecrets(secrets map[string]string)
+	// Replace creates and starts a new container for every existing one and returns the ips of the new containers,
+	// the existing containers are kept and need to be removed with Delete
+	Replace() ([]string, error)
+	// Probe checks whether the container with the ip is healthy
+	Probe(ip string) error
+	// ContainerIP returns the ip of a container of the deployment by its id, empty if the container is not part of it
+	ContainerIP(container string) string
 }
 
-func New(id string, rproxyListenAddr string, rproxyConfigPort int, backend Backend) *ControlPlane {
+func New(id string, rproxyListenAddr string, rproxyConfigPort int, backend Backend, store Store) *ControlPlane {
 	return &ControlPlane{
 		id:                 id,
 		FunctionHandlers:   make(map[string]Handler),
 		functionHandlerMtx: sync.Mutex{},
+		functionLocks:      make(map[string]*sync.Mutex),
 		rproxyListenAddr:   rproxyListenAddr,
 		rproxyConfigPort:   rproxyConfigPort,
+		rproxyClient:       http.DefaultClient,
 		backend:            backend,
+		store:              store,
+		stopWatching:       func() {},
+		exits:              make(map[string][]ContainerExit),
+		DrainGrace:         DefaultDrainGrace,
+		ImageRetention:     DefaultImageRetention,
+		HealthInterval:     DefaultHealthInterval,
+		health:             make(map[string]*deploymentHealth),
+		stopMonitoring:     func() {},
+		rollouts: rollouts{
+			latest: make(map[string]*rollout),
+			drains: make(map[*rollout]struct{}),
+		},
 	}
 }
 
-func (cp *ControlPlane) Stop() error {
-	log.Printf("not implemented yet...")
+// Restore rebuilds the handlers of all deployments in the store, registers them at the rproxy and
+// routes the aliases of every function to them. Deployments which can't be restored anymore (e.g. their
+// containers are gone) are removed from the store. Aliases without a deployment, e.g. after a graceful
+// Stop, are deployed again from the image of their version.
+func (cp *ControlPlane) Restore() error {
+	states, err := cp.store.Deployments()
+	if err != nil {
+		log.Printf("not able to load deployments from the store: %v", err)
+		return err
+	}
+
+	log.Printf("restoring %d deployments from the store", len(states))
+
+	var errs []error
+	for _, state := range states {
+		secrets, err := cp.store.Secrets(state.Name)
+		if err != nil {
+			log.Printf("not able to load secrets of function %s: %v", state.Name, err)
+			errs = append(errs, fmt.Errorf("restoring deployment %s: %w", state.UniqueName, err))
+			continue
+		}
+
+		// new containers follow the current trust of the operator
+		state.Trusted = cp.trusted(state.Name)
+
+		handler, err := cp.backend.Restore(state, secrets)
+		if err != nil {
+			log.Printf("not able to restore deployment %s, forgetting it: %v", state.UniqueName, err)
+			errs = append(errs, fmt.Errorf("restoring deployment %s: %w", state.UniqueName, err))
+			err = cp.store.DeleteDeployment(state.UniqueName)
+			if err != nil {
+				log.Printf("not able to remove deployment %s from the store: %v", state.UniqueName, err)
+			}
+			continue
+		}
+
+		cp.activate(handler)
+		// the ips might have changed, e.g. if docker was restarted
+		cp.persist(handler)
+
+		err = cp.registerWithRetries(state.Name, state.UniqueName, handler.IPs(), state.FunctionConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("registering restored deployment %s: %w", state.UniqueName, err))
+			continue
+		}
+
+		log.Printf("restored deployment %s of function %s with ips: %v", state.UniqueName, state.Name, handler.IPs())
+	}
+
+	// functions which were stopped gracefully have no deployments left, their aliases are deployed again
+	names, err := cp.store.Functions()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	for _, name := range names {
+		err = cp.restoreAliases(name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// restoreAliases routes the aliases of a function to their versions and deploys them if needed
+func (cp *ControlPlane) restoreAliases(name string) error {
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	h, err := cp.store.Versions(name)
+	if err != nil {
+		return fmt.Errorf("restoring aliases of function %s: %w", name, err)
+	}
+
+	var errs []error
+	for alias, number := range h.Aliases {
+		err = cp.pointAlias(&h, alias, number)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restoring alias %s of function %s: %w", alias, name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reconcile cleans up or adopts the resources of this instance which are not in the store, e.g. after a crash during a
+// deployment. It must be called after Restore, so the restored deployments and the images of all versions are kept.
+// Adopted functions are registered at the rproxy so they can serve requests right away. As their history is unknown,
+// the adopted deployment becomes the first version of the function.
+func (cp *ControlPlane) Reconcile(policy ReconcilePolicy) error {
+	log.Printf("reconciling orphaned resources with policy: %s", policy)
+
+	known, err := cp.known()
+	if err != nil {
+		log.Printf("not able to load the functions of the store: %v", err)
+		return err
+	}
+
+	adopted, err := cp.backend.Reconcile(policy, known)
+	if err != nil {
+		log.Printf("reconciling the backend failed with err: %v", err)
+		return err
+	}
+
+	var errs []error
+	for name, handler := range adopted {
+		err = cp.adopt(name, handler)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Printf("adopted function %s with ips: %v", name, handler.IPs())
+	}
+
+	return errors.Join(errs...)
+}
+
+// adopt makes the deployment of an orphaned function the first version of the function and routes it
+func (cp *ControlPlane) adopt(name string, handler Handler) error {
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	state := handler.State()
+	cp.activate(handler)
+	cp.persist(handler)
+
+	err := cp.registerWithRetries(state.Name, state.UniqueName, handler.IPs(), state.FunctionConfig)
+	if err != nil {
+		return fmt.Errorf("registering adopted function %s: %w", name, err)
+	}
+
+	h := NewVersionHistory(name)
+	h.Versions = append(h.Versions, Version{
+		Number:  state.Version,
+		Image:   state.Image,
+		BuiltAt: state.DeployedAt,
+		Config:  state.FunctionConfig,
+	})
+
+	err = cp.pointAlias(&h, DefaultAlias, state.Version)
+	if err != nil {
+		return fmt.Errorf("routing adopted function %s: %w", name, err)
+	}
+
 	return nil
 }
 
-func (cp *ControlPlane) createFunction(name string, fnzip []byte, subfolderPath string) (string, error) {
+// known returns the names of the functions and the uniqueNames and images of the deployments and versions
+// the control plane knows
+func (cp *ControlPlane) known() (map[string]bool, error) {
+	known := make(map[string]bool)
+	cp.functionHandlerMtx.Lock()
+	for uniqueName, handler := range cp.FunctionHandlers {
+		known[uniqueName] = true
+		known[handler.State().Image] = true
+	}
+	cp.functionHandlerMtx.Unlock()
+
+	states, err := cp.store.Deployments()
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		known[state.UniqueName] = true
+		known[state.Image] = true
+	}
+
+	names, err := cp.store.Functions()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		known[name] = true
+
+		h, err := cp.store.Versions(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range h.Versions {
+			known[v.Image] = true
+		}
+	}
+
+	return known, nil
+}
+
+// Stop rejects further uploads and scale requests and destroys the deployments of every function in parallel.
+// Only the containers are torn down, the versions, their images and the secrets stay in the store, so Restore
+// deploys the aliases again on the next start. Deployments which could not be destroyed within DestroyTimeout
+// are reported in the returned error, afterward the backend removes whatever containers are left.
+func (cp *ControlPlane) Stop() error {
+	// replenish checks stopping under the lock, so no replacement is added once Wait started
+	cp.functionHandlerMtx.Lock()
+	cp.stopping.Store(true)
+	cp.functionHandlerMtx.Unlock()
+	cp.stopWatching()
+	cp.stopMonitoring()
+	cp.replacements.Wait()
+
+	cp.functionHandlerMtx.Lock()
+	handlers := cp.FunctionHandlers
+	cp.FunctionHandlers = make(map[string]Handler)
+	cp.functionHandlerMtx.Unlock()
+
+	log.Printf("stopping controlplane, destroying %d deployments", len(handlers))
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	results := make(chan result, len(handlers))
+	for name, handler := range handlers {
+		go func(name string, handler Handler) {
+			results <- result{name: name, err: handler.Destroy()}
+		}(name, handler)
+	}
+
+	var errs []error
+	pending := make(map[string]struct{}, len(handlers))
+	for name := range handlers {
+		pending[name] = struct{}{}
+	}
+
+	timeout := time.After(DestroyTimeout)
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.name)
+			if r.err != nil {
+				log.Printf("destroying deployment %s failed with err: %v", r.name, r.err)
+				errs = append(errs, fmt.Errorf("destroying deployment %s: %w", r.name, r.err))
+				continue
+			}
+
+			// the versions, aliases and secrets are kept, the aliases are deployed again on the next start
+			err := cp.store.DeleteDeployment(r.name)
+			if err != nil {
+				log.Printf("not able to remove deployment %s from the store: %v", r.name, err)
+			}
+		case <-timeout:
+			for name := range pending {
+				log.Printf("destroying deployment %s did not finish within %v", name, DestroyTimeout)
+				errs = append(errs, fmt.Errorf("destroying deployment %s: timed out after %v", name, DestroyTimeout))
+			}
+			clear(pending)
+		}
+	}
+
+	// replaced deployments which still drain are destroyed as well
+	cp.stopDrains()
+
+	err := cp.backend.Stop()
+	if err != nil {
+		log.Printf("stopping the backend failed with err: %v", err)
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (cp *ControlPlane) createFunction(name string, fnzip []byte, subfolderPath string, rawConfig []byte, secrets map[string]string, aliases []string) (Version, error) {
 	log.Printf("createFunction received following args: %s, %d", name, len(fnzip))
 	uuid, err := uuid2.NewRandom()
 	if err != nil {
 		log.Printf("not able to create uuid with error: %v", err)
-		return "", err
+		return Version{}, err
 	}
 
 	log.Printf("creating function %s, with uuid: %s", name, uuid.String())
@@ -81,19 +442,19 @@ func (cp *ControlPlane) createFunction(name string, fnzip []byte, subfolderPath
 	err = os.MkdirAll(p, 0777)
 	if err != nil {
 		log.Printf("not able to create directory: %s with err: %v", p, err)
-		return "", err
+		return Version{}, err
 	}
 
 	zipPath := path.Join(TmpDir, uuid.String()+".zip")
 	err = os.WriteFile(zipPath, fnzip, 0777)
 	if err != nil {
-		return "", err
+		return Version{}, err
 	}
 
 	err = util.Unzip(zipPath, p)
 	if err != nil {
 		log.Printf("not able to unzip function zip: %v", err)
-		return "", err
+		return Version{}, err
 	}
 
 	// Remove all Temp Directories that are not longer needed
@@ -116,148 +477,424 @@ func (cp *ControlPlane) createFunction(name string, fnzip []byte, subfolderPath
 		p = path.Join(p, subfolderPath)
 	}
 
-	// What are we doing if the function already exists? -> Deploy a new one
-
-	var oldHandler Handler
-	if existingHandler, ok := cp.FunctionHandlers[name]; ok {
-		oldHandler = existingHandler
+	// The manifest in the zip is the base, the config of the upload request overrides it
+	manifest, err := os.ReadFile(path.Join(p, ManifestFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("not able to read manifest of function %s: %v", name, err)
+		return Version{}, err
 	}
 
-	cp.functionHandlerMtx.Lock()
-	defer cp.functionHandlerMtx.Unlock()
+	config, err := ParseConfig(manifest, rawConfig)
+	if err != nil {
+		log.Printf("config of function %s is not valid: %v", name, err)
+		return Version{}, err
+	}
 
-	// Now just Mock stuff, need to switch the upload script!
-	// Hier kriegen wir einen Handler zurück!
-	// TODO
-	fh, err := cp.backend.Create(name, p, 1, 10)
+	err = validateSecrets(secrets)
 	if err != nil {
-		log.Printf("creating the function handler failed with err: %v", err)
-		return "", err
+		return Version{}, err
 	}
 
-	log.Printf("DEBUG: Created function handler: %+v (should not have IPs for now)", fh)
+	log.Printf("building function %s with config: %+v", name, config)
+
+	image, err := cp.backend.Build(name, p, config)
+	if err != nil {
+		log.Printf("building function %s failed with err: %v", name, err)
+		return Version{}, err
+	}
 
-	cp.FunctionHandlers[name] = fh
+	unlock := cp.lockFunction(name)
+	defer unlock()
 
-	err = cp.FunctionHandlers[name].Start()
+	h, err := cp.store.Versions(name)
 	if err != nil {
-		return "", err
+		return Version{}, err
 	}
 
-	// Register function at the RProxy
-	d := struct {
-		FunctionName string   `json:"name"`
-		FunctionIPs  []string `json:"ips"`
-	}{
-		FunctionName: name,
-		FunctionIPs:  fh.IPs(),
+	hash := sha256.Sum256(fnzip)
+	v := Version{
+		Number:  h.next(),
+		Image:   image,
+		ZipHash: hex.EncodeToString(hash[:]),
+		BuiltAt: time.Now(),
+		Config:  config,
 	}
 
-	b, err := json.Marshal(d)
+	// every build is kept, so aliases can be pointed back to it later on
+	h.Versions = append(h.Versions, v)
+	err = cp.store.PutVersions(h)
 	if err != nil {
-		log.Printf("failed to marshall the payload to register the function at the proxy: %v", err)
-		return "", err
+		log.Printf("not able to persist the versions of function %s: %v", name, err)
+		return Version{}, err
 	}
 
-	log.Printf("telling rproxy about new function %s, with ips %v, : %+v", name, fh.IPs(), d)
-
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d", cp.rproxyListenAddr, cp.rproxyConfigPort), "application/json", bytes.NewBuffer(b))
-	if err != nil && errors.Is(err, io.EOF) {
-		log.Printf("error telling rproxy about the new function %s: %v", name, err)
-		return "", err
+	// A redeploy keeps the secrets of the function, new ones are added
+	stored, err := cp.store.Secrets(name)
+	if err != nil {
+		log.Printf("not able to load secrets of function %s: %v", name, err)
+		return Version{}, err
 	}
+	maps.Copy(stored, secrets)
 
-	if resp.StatusCode != http.StatusOK {
-		// could add any form of retries, but not important for now
-		log.Printf("received a not expected status code from rproxy: %d", resp.StatusCode)
-		return "", fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
+	err = cp.store.PutSecrets(name, stored)
+	if err != nil {
+		log.Printf("not able to persist secrets of function %s: %v", name, err)
+		return Version{}, err
 	}
 
-	if oldHandler != nil {
-		err = oldHandler.Destroy()
+	// the previous version keeps serving until the new one is started and routed to
+	for _, alias := range append([]string{DefaultAlias}, aliases...) {
+		err = cp.pointAlias(&h, alias, v.Number)
 		if err != nil {
-			return "", err
+			return Version{}, err
 		}
 	}
 
-	return name, nil
+	return v, nil
 }
 
-func (cp *ControlPlane) Upload(name string, zippedString string) (string, error) {
+// Upload builds a new version of the zipped function and points the default alias and the given aliases to it.
+// rawConfig is an optional JSON encoded FunctionConfig and secrets are added to the secrets the function already has.
+// The url of the function and the new version are returned.
+func (cp *ControlPlane) Upload(name string, zippedString string, rawConfig []byte, secrets map[string]string, aliases []string) (string, Version, error) {
+	if cp.stopping.Load() {
+		return "", Version{}, ErrShuttingDown
+	}
+
+	if !validName(name) {
+		return "", Version{}, fmt.Errorf("%w: function %q", ErrInvalidName, name)
+	}
+
+	for _, alias := range aliases {
+		if !validName(alias) {
+			return "", Version{}, fmt.Errorf("%w: alias %q", ErrInvalidName, alias)
+		}
+	}
 
 	//base64 decode zip
 	zip, err := base64.StdEncoding.DecodeString(zippedString)
 	if err != nil {
 		log.Printf("not able to base64 decode the zipped with err: %v", err)
-		return "", err
+		return "", Version{}, err
 	}
 
-	functionName, err := cp.createFunction(name, zip, "")
+	v, err := cp.createFunction(name, zip, "", rawConfig, secrets, aliases)
 	if err != nil {
 		log.Printf("not able to create function: %s with error: %v", name, err)
-		return "", err
+		return "", Version{}, err
 	}
 
-	r := fmt.Sprintf("http://%s:%d/%s\n", cp.rproxyListenAddr, 8093, functionName)
+	scheme := "ws"
+	if cp.rproxyTLS {
+		scheme = "wss"
+	}
+	r := fmt.Sprintf("%s://%s:%d/%s\n", scheme, cp.rproxyListenAddr, 8093, name)
 
-	return r, nil
+	return r, v, nil
 }
 
-// Scale Wie kriegen wir die IPs wieder zum Proxy?
-// returns: a list of IPs which have been added
+// Scale Wie kriegen wir die IPs wieder zum Proxy? name is the uniqueName of the deployment the rproxy scales
+// returns: a list of IPs which have been added, if an error occurs these are the ips of the containers started before
 func (cp *ControlPlane) Scale(name string, amount int) ([]string, error) {
 	log.Printf("now scaling function with name: %s and amount: %d", name, amount)
-	var handler Handler
-	if existingHandler, ok := cp.FunctionHandlers[name]; ok {
-		handler = existingHandler
-	} else {
-		return nil, http.ErrMissingFile // Represents
+	if cp.stopping.Load() {
+		return nil, ErrShuttingDown
+	}
+
+	// the containers are started without holding a lock, the handler guards its containers itself
+	handler, ok := cp.active(name)
+	if !ok {
+		return nil, ErrFunctionNotFound
 	}
 
 	// If we have the handler, what do we want to do!
 	// Create a new Container! -> Start the container -> and return IPs to the RProxy so it can add them!
 
-	// Before we are creating a new function -> get IPs than find differences
-
 	var ips []string
 
 	for i := 0; i < amount; i++ {
-		prev := handler.IPs()
-		log.Printf("ips of function handler before scaling: %v", prev)
 		containerName, err := handler.Add()
 
 		log.Printf("added new container with name: %s", containerName)
 
+		// the containers started so far are handed out anyway, the rproxy can use them
 		if err != nil {
-			return nil, err
+			cp.persistActive(name, handler)
+			return ips, err
+		}
+
+		ip, err := handler.StartContainer(containerName)
+		if err != nil {
+			cp.persistActive(name, handler)
+			return ips, err
 		}
 
-		err = handler.StartContainer(containerName)
+		log.Printf("started container %s with ip: %s", containerName, ip)
+		ips = append(ips, ip)
+	}
+
+	cp.persistActive(name, handler)
+
+	return ips, nil
+}
+
+// SetSecrets updates the secrets of a function, a nil value removes the secret.
+// The containers of every deployment of the function are replaced, so every container sees the new secrets.
+// The names of all secrets of the function are returned, their values never leave the control plane.
+func (cp *ControlPlane) SetSecrets(name string, secrets map[string]*string) ([]string, error) {
+	log.Printf("now updating %d secrets of function %s", len(secrets), name)
+
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	deployments := cp.deployments(name)
+	if len(deployments) == 0 {
+		return nil, ErrFunctionNotFound
+	}
+
+	stored, err := cp.store.Secrets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range secrets {
+		if v == nil {
+			delete(stored, k)
+			continue
+		}
+		stored[k] = *v
+	}
+
+	err = validateSecrets(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cp.store.PutSecrets(name, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	for uniqueName, handler := range deployments {
+		handler.SetSecrets(stored)
+
+		err = cp.replaceContainers(uniqueName, handler)
 		if err != nil {
+			log.Printf("replacing the containers of deployment %s failed with err: %v", uniqueName, err)
 			return nil, err
 		}
+	}
+
+	return slices.Sorted(maps.Keys(stored)), nil
+}
+
+// replaceContainers starts a new container for every container of the deployment and points the rproxy
+// to the new containers. The old ones finish their sessions and are removed once drained, see drainContainers.
+// The function must be locked, see lockFunction
+func (cp *ControlPlane) replaceContainers(uniqueName string, handler Handler) error {
+	old := slices.Clone(handler.IPs())
+	if len(old) == 0 {
+		// scaled to zero, the next container is created with the new config anyway
+		return nil
+	}
+
+	ips, err := handler.Replace()
+	cp.persist(handler)
+	if err != nil {
+		return err
+	}
+
+	err = cp.addEndpoints(uniqueName, ips)
+	if err != nil {
+		return err
+	}
+
+	// the old containers get no new sessions, the running ones keep going
+	err = cp.removeEndpoints(uniqueName, old)
+	if err != nil {
+		return err
+	}
+
+	cp.drainContainers(uniqueName, handler, old)
+
+	return nil
+}
+
+// ScaleIn removes the containers with the given ips from the deployment with the uniqueName name,
+// it is called by the rproxy for containers which have been idle for too long.
+func (cp *ControlPlane) ScaleIn(name string, ips []string) error {
+	log.Printf("now scaling in function with name: %s and ips: %v", name, ips)
+
+	handler, ok := cp.active(name)
+	if !ok {
+		return ErrFunctionNotFound
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		err := handler.Delete(ip)
+		if err != nil {
+			log.Printf("not able to remove container with ip %s of function %s: %v", ip, name, err)
+			errs = append(errs, err)
+		}
+	}
+
+	cp.persistActive(name, handler)
+
+	return errors.Join(errs...)
+}
 
-		log.Printf("started container successfully")
+// Delete removes the function from the rproxy and destroys all of its deployments and versions.
+// If force is false and the function still serves sessions, ErrFunctionBusy is returned
+// and the function stays deployed. With force, active sessions are cut off.
+func (cp *ControlPlane) Delete(name string, force bool) error {
+	log.Printf("now deleting function with name: %s (force: %t)", name, force)
 
-		curr := handler.IPs()
+	unlock := cp.lockFunction(name)
+	defer unlock()
 
-		log.Printf("ips of function handler after scaling: %v", curr)
-		slices.Sort(prev)
-		slices.Sort(curr)
+	h, err := cp.store.Versions(name)
+	if err != nil {
+		return err
+	}
+
+	deployments := cp.deployments(name)
+	if len(deployments) == 0 && len(h.Versions) == 0 {
+		return ErrFunctionNotFound
+	}
 
-		for i := 0; i < len(prev); i++ {
-			if prev[i] != curr[i] {
-				containerName = curr[i]
-				log.Printf("extracting containerName? is: %s", curr[i])
+	if !force {
+		// checked upfront, so a busy function is not left half deleted
+		for _, uniqueName := range slices.Concat(slices.Collect(maps.Keys(deployments)), cp.draining(name)) {
+			sessions, err := cp.sessions(uniqueName)
+			if err != nil {
+				return err
+			}
+			if sessions > 0 {
+				log.Printf("deployment %s of function %s still serves %d sessions", uniqueName, name, sessions)
+				return ErrFunctionBusy
 			}
 		}
+	}
 
-		ip := curr[len(curr)-1]
-		log.Printf("determined ip: %s and add this to ips: %v", ip, ips)
-		ips = append(ips, ip)
-		log.Printf("added ip to ips: %v", ips)
+	// no new sessions are routed to the function once its aliases are gone
+	for alias := range h.Aliases {
+		err = cp.deleteRoute(routeName(name, alias))
+		if err != nil {
+			log.Printf("not able to remove alias %s of function %s from the rproxy: %v", alias, name, err)
+			return err
+		}
+	}
+
+	cp.abortDrains(name)
+
+	var errs []error
+	for uniqueName, handler := range deployments {
+		err = cp.deregisterAtRProxy(uniqueName, force)
+		if err != nil {
+			log.Printf("not able to deregister deployment %s at the rproxy: %v", uniqueName, err)
+			errs = append(errs, err)
+		}
 
+		cp.functionHandlerMtx.Lock()
+		delete(cp.FunctionHandlers, uniqueName)
+		cp.functionHandlerMtx.Unlock()
+
+		err = handler.Destroy()
+		if err != nil {
+			log.Printf("destroying deployment %s failed with err: %v", uniqueName, err)
+			errs = append(errs, err)
+		}
 	}
 
-	return ips, nil
+	for _, v := range h.Versions {
+		if v.Pruned {
+			continue
+		}
+
+		err = cp.backend.RemoveImage(v.Image)
+		if err != nil {
+			log.Printf("not able to remove image %s of version %d of function %s: %v", v.Image, v.Number, name, err)
+			errs = append(errs, err)
+		}
+	}
+
+	err = cp.store.DeleteFunction(name)
+	if err != nil {
+		log.Printf("not able to remove function %s from the store: %v", name, err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	log.Printf("deleted function %s", name)
+	return nil
+}
+
+// trusted reports whether the operator trusts the function to run without the hardened container profile
+func (cp *ControlPlane) trusted(name string) bool {
+	return slices.Contains(cp.Trusted, name)
+}
+
+// validateSecrets checks that secrets can be injected as environment variables
+func validateSecrets(secrets map[string]string) error {
+	for k := range secrets {
+		if !validEnvName(k) {
+			return fmt.Errorf("%w: invalid secret name %q", ErrInvalidConfig, k)
+		}
+	}
+	return nil
+}
+
+// lockFunction locks the function with the name and returns the func to unlock it. The deployments of other
+// functions are not blocked, so it may be held while containers are started. cp.functionHandlerMtx must not be held.
+func (cp *ControlPlane) lockFunction(name string) func() {
+	cp.functionHandlerMtx.Lock()
+	mtx, ok := cp.functionLocks[name]
+	if !ok {
+		mtx = &sync.Mutex{}
+		cp.functionLocks[name] = mtx
+	}
+	cp.functionHandlerMtx.Unlock()
+
+	mtx.Lock()
+	return mtx.Unlock
+}
+
+// active returns the active deployment with the uniqueName
+func (cp *ControlPlane) active(uniqueName string) (Handler, bool) {
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	handler, ok := cp.FunctionHandlers[uniqueName]
+	return handler, ok
+}
+
+// activate makes the deployment an active one, it is scaled and monitored from now on
+func (cp *ControlPlane) activate(handler Handler) {
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	cp.FunctionHandlers[handler.State().UniqueName] = handler
+}
+
+// persistActive persists the deployment unless it was retired in the meantime, which removed it from the store
+func (cp *ControlPlane) persistActive(uniqueName string, handler Handler) {
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	if cp.FunctionHandlers[uniqueName] == handler {
+		cp.persist(handler)
+	}
+}
+
+// persist writes the current state of the function into the store, the function keeps working
+// if that fails, it just can't be restored after a restart
+func (cp *ControlPlane) persist(handler Handler) {
+	state := handler.State()
+	err := cp.store.PutDeployment(state)
+	if err != nil {
+		log.Printf("not able to persist deployment %s of function %s: %v", state.UniqueName, state.Name, err)
+	}
 }
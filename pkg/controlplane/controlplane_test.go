@@ -0,0 +1,465 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHandler is a deployment whose containers only exist in memory
+type fakeHandler struct {
+	backend    *fakeBackend
+	state      FunctionState
+	containers map[string]string
+	secrets    map[string]string
+	destroyed  bool
+	mtx        sync.Mutex
+}
+
+func (h *fakeHandler) IPs() []string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return slices.Clone(h.state.IPs)
+}
+
+func (h *fakeHandler) Add() (string, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if len(h.state.Containers) >= h.state.MaxThreads {
+		return "", ErrMaxThreads
+	}
+
+	id := fmt.Sprintf("%s-%d", h.state.UniqueName, len(h.containers))
+	h.containers[id] = ""
+	h.state.Containers = append(h.state.Containers, id)
+	return id, nil
+}
+
+func (h *fakeHandler) StartContainer(name string) (string, error) {
+	ip := h.backend.nextIP()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.containers[name] = ip
+	h.state.IPs = append(h.state.IPs, ip)
+	return ip, nil
+}
+
+func (h *fakeHandler) Start() error {
+	h.backend.mtx.Lock()
+	block := h.backend.block[h.state.Name]
+	h.backend.mtx.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	for i := 0; i < h.state.InitThreads; i++ {
+		id, err := h.Add()
+		if err != nil {
+			return err
+		}
+
+		_, err = h.StartContainer(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *fakeHandler) Delete(ip string) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for id, containerIP := range h.containers {
+		if containerIP == ip {
+			delete(h.containers, id)
+			h.state.Containers = slices.DeleteFunc(h.state.Containers, func(c string) bool { return c == id })
+		}
+	}
+	h.state.IPs = slices.DeleteFunc(h.state.IPs, func(i string) bool { return i == ip })
+	return nil
+}
+
+func (h *fakeHandler) Destroy() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.destroyed = true
+	h.containers = make(map[string]string)
+	h.state.Containers = nil
+	h.state.IPs = nil
+	return nil
+}
+
+func (h *fakeHandler) Logs() (io.Reader, error) {
+	return strings.NewReader(""), nil
+}
+
+func (h *fakeHandler) State() FunctionState {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	state := h.state
+	state.Containers = slices.Clone(h.state.Containers)
+	state.IPs = slices.Clone(h.state.IPs)
+	return state
+}
+
+func (h *fakeHandler) SetSecrets(secrets map[string]string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.secrets = secrets
+}
+
+func (h *fakeHandler) Replace() ([]string, error) {
+	ips := make([]string, 0)
+	for range h.IPs() {
+		id := fmt.Sprintf("%s-%d", h.state.UniqueName, h.backend.nextID())
+		h.mtx.Lock()
+		h.containers[id] = ""
+		h.state.Containers = append(h.state.Containers, id)
+		h.mtx.Unlock()
+
+		ip, err := h.StartContainer(id)
+		if err != nil {
+			return ips, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (h *fakeHandler) Probe(ip string) error {
+	return nil
+}
+
+func (h *fakeHandler) ContainerIP(container string) string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.containers[container]
+}
+
+// fakeBackend deploys fakeHandlers, the deployments of a function in block don't start until the channel is closed
+type fakeBackend struct {
+	mtx      sync.Mutex
+	handlers map[string]*fakeHandler
+	block    map[string]chan struct{}
+	removed  []string
+	ids      int
+	ips      int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		handlers: make(map[string]*fakeHandler),
+		block:    make(map[string]chan struct{}),
+	}
+}
+
+func (b *fakeBackend) nextID() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.ids++
+	return b.ids
+}
+
+func (b *fakeBackend) nextIP() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.ips++
+	return fmt.Sprintf("10.0.%d.%d", b.ips/256, b.ips%256)
+}
+
+func (b *fakeBackend) Build(name string, filedir string, config FunctionConfig) (string, error) {
+	return fmt.Sprintf("%s-image-%d", name, b.nextID()), nil
+}
+
+func (b *fakeBackend) Deploy(name string, version Version, secrets map[string]string) (Handler, error) {
+	h := &fakeHandler{
+		backend: b,
+		state: FunctionState{
+			Name:           name,
+			UniqueName:     fmt.Sprintf("%s-%d-%d", name, version.Number, b.nextID()),
+			Version:        version.Number,
+			Image:          version.Image,
+			DeployedAt:     time.Now(),
+			FunctionConfig: version.Config,
+		},
+		containers: make(map[string]string),
+		secrets:    secrets,
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.handlers[h.state.UniqueName] = h
+	return h, nil
+}
+
+func (b *fakeBackend) RemoveImage(image string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.removed = append(b.removed, image)
+	return nil
+}
+
+func (b *fakeBackend) Reconcile(policy ReconcilePolicy, known map[string]bool) (map[string]Handler, error) {
+	return nil, nil
+}
+
+func (b *fakeBackend) Restore(state FunctionState, secrets map[string]string) (Handler, error) {
+	return nil, fmt.Errorf("restoring %s is not supported", state.UniqueName)
+}
+
+func (b *fakeBackend) Watch(ctx context.Context, report func(ContainerExit)) {}
+
+func (b *fakeBackend) Stop() error {
+	return nil
+}
+
+// fakeRProxy records what the control plane tells the config endpoint of the rproxy
+type fakeRProxy struct {
+	mtx sync.Mutex
+	// ips by uniqueName
+	functions map[string][]string
+	routes    map[string][]routeBackend
+}
+
+func (p *fakeRProxy) route(route string) []routeBackend {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.routes[route]
+}
+
+func (p *fakeRProxy) ips(uniqueName string) ([]string, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ips, ok := p.functions[uniqueName]
+	return ips, ok
+}
+
+func (p *fakeRProxy) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	decodeIPs := func(req *http.Request) []string {
+		d := struct {
+			IPs []string `json:"ips"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&d)
+		return d.IPs
+	}
+
+	mux.HandleFunc("PUT /functions/{name}", func(w http.ResponseWriter, req *http.Request) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.functions[req.PathValue("name")] = decodeIPs(req)
+	})
+	mux.HandleFunc("PATCH /functions/{name}/settings", func(w http.ResponseWriter, req *http.Request) {})
+	mux.HandleFunc("GET /functions/{name}", func(w http.ResponseWriter, req *http.Request) {
+		http.NotFound(w, req)
+	})
+	mux.HandleFunc("DELETE /functions/{name}", func(w http.ResponseWriter, req *http.Request) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		delete(p.functions, req.PathValue("name"))
+	})
+	mux.HandleFunc("POST /functions/{name}/endpoints", func(w http.ResponseWriter, req *http.Request) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		name := req.PathValue("name")
+		p.functions[name] = append(p.functions[name], decodeIPs(req)...)
+	})
+	mux.HandleFunc("DELETE /functions/{name}/endpoints", func(w http.ResponseWriter, req *http.Request) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		name := req.PathValue("name")
+		removed := decodeIPs(req)
+		p.functions[name] = slices.DeleteFunc(p.functions[name], func(ip string) bool { return slices.Contains(removed, ip) })
+	})
+	mux.HandleFunc("PUT /routes/{route...}", func(w http.ResponseWriter, req *http.Request) {
+		d := struct {
+			Backends []routeBackend `json:"backends"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&d)
+
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.routes[req.PathValue("route")] = d.Backends
+	})
+	mux.HandleFunc("DELETE /routes/{route...}", func(w http.ResponseWriter, req *http.Request) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		delete(p.routes, req.PathValue("route"))
+	})
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{}"))
+	})
+
+	return mux
+}
+
+// newTestControlPlane returns a control plane with a fake backend, a FileStore in a temporary directory and a fake rproxy
+func newTestControlPlane(t *testing.T) (*ControlPlane, *fakeBackend, *fakeRProxy) {
+	t.Helper()
+
+	proxy := &fakeRProxy{
+		functions: make(map[string][]string),
+		routes:    make(map[string][]routeBackend),
+	}
+	srv := httptest.NewServer(proxy.handler())
+	t.Cleanup(srv.Close)
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPort, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newFakeBackend()
+	cp := New("test", host, configPort, backend, store)
+	cp.DrainGrace = 0
+	return cp, backend, proxy
+}
+
+// putVersions adds versions to a function with the default config and the images <name>-image-<number>
+func putVersions(t *testing.T, cp *ControlPlane, name string, numbers ...int) {
+	t.Helper()
+
+	h, err := cp.store.Versions(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range numbers {
+		config := DefaultConfig()
+		config.InitThreads = 1
+		h.Versions = append(h.Versions, Version{Number: n, Image: fmt.Sprintf("%s-image-%d", name, n), Config: config})
+	}
+
+	err = cp.store.PutVersions(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Starting the containers of one function must not block the deployments of other functions
+func TestScaleDuringDeploy(t *testing.T) {
+	cp, backend, _ := newTestControlPlane(t)
+
+	putVersions(t, cp, "echo", 1)
+	putVersions(t, cp, "slow", 1)
+
+	err := cp.SetAlias("echo", DefaultAlias, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := cp.deployment("echo", 1)
+
+	block := make(chan struct{})
+	backend.mtx.Lock()
+	backend.block["slow"] = block
+	backend.mtx.Unlock()
+
+	deployed := make(chan error, 1)
+	go func() {
+		deployed <- cp.SetAlias("slow", DefaultAlias, 1)
+	}()
+
+	scaled := make(chan error, 1)
+	go func() {
+		_, err := cp.Scale(echo.State().UniqueName, 1)
+		scaled <- err
+	}()
+
+	select {
+	case err = <-scaled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("scaling a function is blocked by the deployment of another one")
+	}
+
+	if _, err := cp.Describe("echo"); err != nil {
+		t.Fatalf("expected the function to be described during the deployment of another one, got %v", err)
+	}
+
+	close(block)
+	if err = <-deployed; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(echo.IPs()) != 2 {
+		t.Fatalf("expected the scaled deployment to have 2 containers, got %v", echo.IPs())
+	}
+}
+
+// Once Stop destroyed the active deployments, a deployment which finishes afterward is destroyed as well
+func TestDeployDuringStop(t *testing.T) {
+	cp, backend, _ := newTestControlPlane(t)
+	putVersions(t, cp, "slow", 1)
+
+	block := make(chan struct{})
+	backend.mtx.Lock()
+	backend.block["slow"] = block
+	backend.mtx.Unlock()
+
+	deployed := make(chan error, 1)
+	go func() {
+		deployed <- cp.SetAlias("slow", DefaultAlias, 1)
+	}()
+
+	// the deployment is waiting in Start
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		backend.mtx.Lock()
+		n := len(backend.handlers)
+		backend.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("deployment was not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := cp.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(block)
+	if err = <-deployed; err != ErrShuttingDown {
+		t.Fatalf("expected %v, got %v", ErrShuttingDown, err)
+	}
+
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+	for _, h := range backend.handlers {
+		if !h.destroyed {
+			t.Fatalf("expected deployment %s to be destroyed", h.state.UniqueName)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// FunctionDescription is what the control plane reports about a deployed function
+type FunctionDescription struct {
+	Name string `json:"name"`
+	// Aliases map the alias name to the version it points to
+	Aliases map[string]int `json:"aliases"`
+	// Versions are all versions of the function, deployed or not
+	Versions []Version `json:"versions"`
+	// Deployments are the running versions of the function, one per version an alias points to
+	Deployments []DeploymentDescription `json:"deployments"`
+	// Secrets only lists the names of the secrets, never their values
+	Secrets []string `json:"secrets,omitempty"`
+	// Exits are the most recent containers which died unexpectedly, e.g. because they ran out of memory
+	Exits []ContainerExit `json:"exits,omitempty"`
+	// Rollout is the progress of the latest change of an alias, nil for functions restored on startup
+	Rollout *Rollout `json:"rollout,omitempty"`
+}
+
+// DeploymentDescription is a running version of a function
+type DeploymentDescription struct {
+	FunctionState
+	// RProxy is nil if the rproxy could not be asked about the deployment
+	RProxy *ProxyStatus     `json:"rproxy,omitempty"`
+	Health DeploymentHealth `json:"health"`
+}
+
+// ProxyStatus is the amount of free and used containers of a deployment in the rproxy and of sessions waiting for one
+type ProxyStatus struct {
+	Free   int `json:"free"`
+	Used   int `json:"used"`
+	Queued int `json:"queued"`
+	// ArrivalRate is the observed rate of new sessions per second
+	ArrivalRate float64 `json:"arrivalRate"`
+	// Draining are the ips of removed containers which still serve a session
+	Draining []string `json:"draining,omitempty"`
+	// Quarantined are the ips of containers which are out of rotation after failed connections
+	Quarantined []string `json:"quarantined,omitempty"`
+	// Reserved are the ips of containers held for sessions which may resume
+	Reserved []string `json:"reserved,omitempty"`
+	// Sessions counts the sessions routed to the deployment, Errors the ones which did not reach a container
+	// and Disconnects the ones which ended with an error, e.g. to judge a canary
+	Sessions    uint64 `json:"sessions"`
+	Errors      uint64 `json:"errors"`
+	Disconnects uint64 `json:"disconnects"`
+}
+
+// List describes every deployed function, sorted by name
+func (cp *ControlPlane) List() []FunctionDescription {
+	proxyStatus := cp.rproxyStatus()
+
+	cp.functionHandlerMtx.Lock()
+	names := make(map[string]bool)
+	for _, handler := range cp.FunctionHandlers {
+		names[handler.State().Name] = true
+	}
+	cp.functionHandlerMtx.Unlock()
+
+	descriptions := make([]FunctionDescription, 0, len(names))
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		descriptions = append(descriptions, cp.describe(name, proxyStatus))
+	}
+
+	return descriptions
+}
+
+// Describe describes a single deployed function
+func (cp *ControlPlane) Describe(name string) (FunctionDescription, error) {
+	proxyStatus := cp.rproxyStatus()
+
+	if len(cp.deployments(name)) == 0 {
+		return FunctionDescription{}, ErrFunctionNotFound
+	}
+
+	return cp.describe(name, proxyStatus), nil
+}
+
+// describe collects the versions and deployments of a function
+func (cp *ControlPlane) describe(name string, proxyStatus map[string]ProxyStatus) FunctionDescription {
+	d := FunctionDescription{
+		Name:        name,
+		Deployments: make([]DeploymentDescription, 0),
+	}
+
+	h, err := cp.store.Versions(name)
+	if err != nil {
+		log.Printf("not able to load versions of function %s: %v", name, err)
+	}
+	d.Aliases = h.Aliases
+	d.Versions = h.Versions
+
+	for uniqueName, handler := range cp.deployments(name) {
+		deployment := DeploymentDescription{
+			FunctionState: handler.State(),
+			Health:        cp.Health(uniqueName),
+		}
+		if status, ok := proxyStatus[uniqueName]; ok {
+			deployment.RProxy = &status
+		}
+		d.Deployments = append(d.Deployments, deployment)
+	}
+
+	slices.SortFunc(d.Deployments, func(a, b DeploymentDescription) int {
+		return a.Version - b.Version
+	})
+
+	secrets, err := cp.store.Secrets(name)
+	if err != nil {
+		log.Printf("not able to load secrets of function %s: %v", name, err)
+	}
+	d.Secrets = slices.Sorted(maps.Keys(secrets))
+	d.Exits = cp.Exits(name)
+
+	if rollout, err := cp.Rollout(name); err == nil {
+		d.Rollout = &rollout
+	}
+
+	return d
+}
+
+// rproxyStatus asks the rproxy for its registry, nil is returned if the rproxy is not reachable
+func (cp *ControlPlane) rproxyStatus() map[string]ProxyStatus {
+	resp, err := cp.rproxyGet("/")
+	if err != nil {
+		log.Printf("not able to fetch the registry of the rproxy: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("received a not expected status code from rproxy: %d", resp.StatusCode)
+		return nil
+	}
+
+	status := make(map[string]ProxyStatus)
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		log.Printf("not able to decode the registry of the rproxy: %v", err)
+		return nil
+	}
+
+	return status
+}
@@ -0,0 +1,59 @@
+package controlplane
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	// MaxExits is the amount of unexpected container exits which are kept per function
+	MaxExits = 10
+)
+
+// ContainerExit describes a container of a function which stopped without being asked to
+type ContainerExit struct {
+	Function  string    `json:"function"`
+	Container string    `json:"container"`
+	ExitCode  int       `json:"exitCode"`
+	OOMKilled bool      `json:"oomKilled"`
+	Time      time.Time `json:"time"`
+}
+
+// Watch starts listening for containers of the backend which die unexpectedly, until Stop is called
+func (cp *ControlPlane) Watch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cp.stopWatching = cancel
+
+	cp.backend.Watch(ctx, func(exit ContainerExit) {
+		cp.recordExit(exit)
+		// replacing the container takes a while, the backend keeps reporting in the meantime
+		go cp.evictExited(exit)
+	})
+}
+
+func (cp *ControlPlane) recordExit(exit ContainerExit) {
+	cause := "crashed"
+	if exit.OOMKilled {
+		cause = "was OOM killed"
+	}
+	log.Printf("container %s of function %s %s (exit code %d)", exit.Container, exit.Function, cause, exit.ExitCode)
+
+	cp.exitsMtx.Lock()
+	defer cp.exitsMtx.Unlock()
+
+	exits := append(cp.exits[exit.Function], exit)
+	if len(exits) > MaxExits {
+		exits = exits[len(exits)-MaxExits:]
+	}
+	cp.exits[exit.Function] = exits
+}
+
+// Exits returns the most recent unexpected container exits of a function, the oldest first
+func (cp *ControlPlane) Exits(name string) []ContainerExit {
+	cp.exitsMtx.Lock()
+	defer cp.exitsMtx.Unlock()
+
+	return slices.Clone(cp.exits[name])
+}
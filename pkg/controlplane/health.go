@@ -0,0 +1,328 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthInterval is the interval in which every container is probed
+	DefaultHealthInterval = 10 * time.Second
+	// HealthFailures is the amount of failed probes in a row after which a container is evicted
+	HealthFailures = 3
+	// CrashLoopEvictions is the amount of evictions of a deployment within CrashLoopWindow which make it crash-looping,
+	// evicted containers of a crash-looping deployment are not replaced until it calms down
+	CrashLoopEvictions = 5
+	CrashLoopWindow    = 5 * time.Minute
+)
+
+// DeploymentHealth is what the health monitor knows about the containers of a deployment
+type DeploymentHealth struct {
+	// Unhealthy are the ips of containers whose latest probe failed
+	Unhealthy []string `json:"unhealthy,omitempty"`
+	// Evictions is the amount of containers evicted or not replaced within CrashLoopWindow
+	Evictions    int       `json:"evictions"`
+	LastEviction time.Time `json:"lastEviction,omitzero"`
+	CrashLooping bool      `json:"crashLooping"`
+}
+
+// deploymentHealth is tracked per uniqueName, guarded by ControlPlane.healthMtx
+type deploymentHealth struct {
+	// failed probes in a row by ip
+	failures map[string]int
+	// times of evictions and failed replacements
+	evictions []time.Time
+	// evicted containers which were not replaced, because the deployment was crash-looping
+	pending bool
+}
+
+// MonitorHealth probes every container of the active deployments each HealthInterval until Stop is called.
+// Containers which fail HealthFailures probes in a row or die (see Watch) are evicted and replaced.
+func (cp *ControlPlane) MonitorHealth() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cp.stopMonitoring = cancel
+
+	go func() {
+		ticker := time.NewTicker(cp.HealthInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			cp.checkHealth()
+		}
+	}()
+}
+
+// checkHealth probes every container of the active deployments in parallel
+func (cp *ControlPlane) checkHealth() {
+	cp.functionHandlerMtx.Lock()
+	handlers := maps.Clone(cp.FunctionHandlers)
+	ips := make(map[string][]string, len(handlers))
+	for uniqueName, handler := range handlers {
+		ips[uniqueName] = slices.Clone(handler.IPs())
+	}
+	cp.functionHandlerMtx.Unlock()
+
+	type probe struct {
+		uniqueName string
+		ip         string
+		err        error
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan probe)
+	for uniqueName, handler := range handlers {
+		for _, ip := range ips[uniqueName] {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results <- probe{uniqueName: uniqueName, ip: ip, err: handler.Probe(ip)}
+			}()
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// ips by uniqueName which failed too many probes
+	evict := make(map[string][]string)
+
+	cp.healthMtx.Lock()
+	for p := range results {
+		h := cp.deploymentHealth(p.uniqueName)
+		if p.err == nil {
+			delete(h.failures, p.ip)
+			continue
+		}
+
+		h.failures[p.ip]++
+		log.Printf("health probe %d/%d of container %s of deployment %s failed: %v", h.failures[p.ip], HealthFailures, p.ip, p.uniqueName, p.err)
+		if h.failures[p.ip] >= HealthFailures {
+			evict[p.uniqueName] = append(evict[p.uniqueName], p.ip)
+		}
+	}
+
+	// deployments which calmed down get back the containers they were missing
+	pending := make([]string, 0)
+	for uniqueName, h := range cp.health {
+		if _, ok := handlers[uniqueName]; !ok {
+			delete(cp.health, uniqueName)
+			continue
+		}
+		if h.pending && !h.crashLooping(time.Now()) {
+			pending = append(pending, uniqueName)
+		}
+	}
+	cp.healthMtx.Unlock()
+
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	for uniqueName, unhealthy := range evict {
+		for _, ip := range unhealthy {
+			cp.evict(uniqueName, ip, fmt.Sprintf("failed %d health probes", HealthFailures))
+		}
+	}
+
+	for _, uniqueName := range pending {
+		cp.replenish(uniqueName)
+	}
+}
+
+// evictExited evicts a container which died, it is called for every unexpected container exit
+func (cp *ControlPlane) evictExited(exit ContainerExit) {
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	for uniqueName, handler := range cp.FunctionHandlers {
+		ip := handler.ContainerIP(exit.Container)
+		if ip == "" {
+			continue
+		}
+
+		cause := "crashed"
+		if exit.OOMKilled {
+			cause = "was OOM killed"
+		}
+		cp.evict(uniqueName, ip, cause)
+		return
+	}
+}
+
+// evict removes an unhealthy container from the rproxy and the deployment, then the deployment is replenished
+// unless it is crash-looping. cp.functionHandlerMtx must be held
+func (cp *ControlPlane) evict(uniqueName string, ip string, reason string) {
+	handler, ok := cp.FunctionHandlers[uniqueName]
+	if !ok || !slices.Contains(handler.IPs(), ip) {
+		// e.g. scaled in or retired in the meantime
+		return
+	}
+
+	log.Printf("evicting container %s of deployment %s, it %s", ip, uniqueName, reason)
+
+	err := cp.removeEndpoints(uniqueName, []string{ip})
+	if err != nil {
+		log.Printf("not able to remove container %s of deployment %s from the rproxy: %v", ip, uniqueName, err)
+	}
+
+	err = handler.Delete(ip)
+	if err != nil {
+		log.Printf("not able to remove container %s of deployment %s: %v", ip, uniqueName, err)
+	}
+	cp.persist(handler)
+
+	now := time.Now()
+	cp.healthMtx.Lock()
+	h := cp.deploymentHealth(uniqueName)
+	delete(h.failures, ip)
+	h.evictions = append(h.evictions, now)
+	crashLooping := h.crashLooping(now)
+	h.pending = crashLooping
+	cp.healthMtx.Unlock()
+
+	if crashLooping {
+		log.Printf("deployment %s is crash-looping (%d evictions within %v), not replacing its containers", uniqueName, CrashLoopEvictions, CrashLoopWindow)
+		return
+	}
+
+	cp.replenish(uniqueName)
+}
+
+// replenish creates containers until the deployment has initThreads again. They are started and added to the
+// rproxy in the background, so the slow start does not block other functions. cp.functionHandlerMtx must be held
+func (cp *ControlPlane) replenish(uniqueName string) {
+	handler, ok := cp.FunctionHandlers[uniqueName]
+	if !ok || cp.stopping.Load() {
+		return
+	}
+
+	cp.healthMtx.Lock()
+	cp.deploymentHealth(uniqueName).pending = false
+	cp.healthMtx.Unlock()
+
+	// containers which are still starting count as well, they are only part of the ips once they are healthy
+	state := handler.State()
+	created := make([]string, 0)
+	for i := len(state.Containers); i < state.InitThreads; i++ {
+		containerName, err := handler.Add()
+		if err != nil {
+			cp.replacementFailed(uniqueName, err)
+			break
+		}
+		created = append(created, containerName)
+	}
+
+	if len(created) == 0 {
+		return
+	}
+
+	cp.replacements.Add(1)
+	go cp.startReplacements(uniqueName, handler, created)
+}
+
+// startReplacements starts the containers created by replenish without holding cp.functionHandlerMtx
+// and adds the healthy ones to the rproxy, unless the deployment was retired in the meantime
+func (cp *ControlPlane) startReplacements(uniqueName string, handler Handler, containers []string) {
+	defer cp.replacements.Done()
+
+	ips := make([]string, 0, len(containers))
+	for _, containerName := range containers {
+		ip, err := handler.StartContainer(containerName)
+		if err != nil {
+			cp.replacementFailed(uniqueName, err)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	if cp.FunctionHandlers[uniqueName] != handler {
+		return
+	}
+	cp.persist(handler)
+
+	if len(ips) == 0 {
+		return
+	}
+
+	log.Printf("replaced evicted containers of deployment %s with %v", uniqueName, ips)
+	err := cp.addEndpoints(uniqueName, ips)
+	if err != nil {
+		log.Printf("not able to add the replacements of deployment %s to the rproxy: %v", uniqueName, err)
+	}
+}
+
+// replacementFailed counts a container which could not be replaced like an eviction, it is retried on a later
+// check and a deployment which keeps failing ends up crash-looping
+func (cp *ControlPlane) replacementFailed(uniqueName string, err error) {
+	log.Printf("not able to replace a container of deployment %s: %v", uniqueName, err)
+
+	cp.healthMtx.Lock()
+	defer cp.healthMtx.Unlock()
+
+	h := cp.deploymentHealth(uniqueName)
+	h.evictions = append(h.evictions, time.Now())
+	h.pending = true
+}
+
+// deploymentHealth returns the health of a deployment and creates it if needed, cp.healthMtx must be held
+func (cp *ControlPlane) deploymentHealth(uniqueName string) *deploymentHealth {
+	h, ok := cp.health[uniqueName]
+	if !ok {
+		h = &deploymentHealth{
+			failures:  make(map[string]int),
+			evictions: make([]time.Time, 0),
+		}
+		cp.health[uniqueName] = h
+	}
+	return h
+}
+
+// crashLooping drops evictions older than CrashLoopWindow and reports whether too many are left
+func (h *deploymentHealth) crashLooping(now time.Time) bool {
+	h.evictions = slices.DeleteFunc(h.evictions, func(t time.Time) bool {
+		return now.Sub(t) > CrashLoopWindow
+	})
+	return len(h.evictions) >= CrashLoopEvictions
+}
+
+// Health returns the health of a deployment by its uniqueName
+func (cp *ControlPlane) Health(uniqueName string) DeploymentHealth {
+	cp.healthMtx.Lock()
+	defer cp.healthMtx.Unlock()
+
+	h, ok := cp.health[uniqueName]
+	if !ok {
+		return DeploymentHealth{}
+	}
+
+	d := DeploymentHealth{
+		CrashLooping: h.crashLooping(time.Now()),
+		Evictions:    len(h.evictions),
+	}
+	if len(h.evictions) > 0 {
+		d.LastEviction = h.evictions[len(h.evictions)-1]
+	}
+	for ip, failures := range h.failures {
+		if failures > 0 {
+			d.Unhealthy = append(d.Unhealthy, ip)
+		}
+	}
+	slices.Sort(d.Unhealthy)
+
+	return d
+}
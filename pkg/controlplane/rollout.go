@@ -0,0 +1,361 @@
+package controlplane
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDrainGrace is how long the containers of a replaced deployment may serve their sessions
+	DefaultDrainGrace = 5 * time.Minute
+	// DrainPollInterval is the interval in which the rproxy is asked for the sessions of a replaced deployment
+	DrainPollInterval = time.Second
+)
+
+// RolloutPhase is the progress of a deployment replacing the previous one
+type RolloutPhase string
+
+const (
+	// RolloutDraining means new sessions go to the new deployment while the old one finishes its sessions
+	RolloutDraining RolloutPhase = "draining"
+	// RolloutCompleted means the old deployment served its last session and was destroyed
+	RolloutCompleted RolloutPhase = "completed"
+	// RolloutExpired means the grace period passed and the remaining sessions of the old deployment were cut off
+	RolloutExpired RolloutPhase = "expired"
+	// RolloutAborted means the old deployment was destroyed early, because the function was deleted or the control plane stopped
+	RolloutAborted RolloutPhase = "aborted"
+	// RolloutFailed means the new deployment did not start and the old one keeps serving
+	RolloutFailed RolloutPhase = "failed"
+)
+
+// Rollout is the progress of the latest change of an alias of a function
+type Rollout struct {
+	Function string `json:"function"`
+	Alias    string `json:"alias"`
+	// From and To are the unique names of the replaced and the new deployment,
+	// To is empty if the alias was removed
+	From        string       `json:"from,omitempty"`
+	FromVersion int          `json:"fromVersion,omitempty"`
+	To          string       `json:"to,omitempty"`
+	ToVersion   int          `json:"toVersion,omitempty"`
+	Phase       RolloutPhase `json:"phase"`
+	// Sessions is the amount of sessions the old deployment still serves
+	Sessions   int       `json:"sessions"`
+	StartedAt  time.Time `json:"startedAt"`
+	Deadline   time.Time `json:"deadline,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// rollout is a Rollout with what the control plane needs to drain the old deployment
+type rollout struct {
+	Rollout
+
+	old Handler
+	// containers are the ips of replaced containers of old, if only they are drained and removed.
+	// Such a drain is not the latest rollout of the function and old keeps serving.
+	containers []string
+	// closed to destroy the old deployment right away
+	abort     chan struct{}
+	abortOnce sync.Once
+	// closed once the old deployment is destroyed
+	done chan struct{}
+}
+
+// rollouts keeps the latest rollout per function and the ones still draining
+type rollouts struct {
+	latest map[string]*rollout
+	drains map[*rollout]struct{}
+	wg     sync.WaitGroup
+	mtx    sync.Mutex
+}
+
+// startRollout records that an alias of a function now points to new and drains the old deployment
+// in the background. old is nil if no deployment has to be drained, new is nil if the alias was removed.
+func (cp *ControlPlane) startRollout(name, alias string, old Handler, new Handler) {
+	now := time.Now()
+	r := &rollout{
+		Rollout: Rollout{
+			Function:  name,
+			Alias:     alias,
+			Phase:     RolloutCompleted,
+			StartedAt: now,
+		},
+		abort: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if new != nil {
+		r.To = new.State().UniqueName
+		r.ToVersion = new.State().Version
+	}
+
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	cp.rollouts.latest[name] = r
+
+	if old == nil {
+		r.FinishedAt = now
+		close(r.done)
+		return
+	}
+
+	r.From = old.State().UniqueName
+	r.FromVersion = old.State().Version
+	r.Phase = RolloutDraining
+	r.Deadline = now.Add(cp.DrainGrace)
+	r.old = old
+
+	cp.rollouts.drains[r] = struct{}{}
+	cp.rollouts.wg.Add(1)
+	go cp.drain(r)
+}
+
+// failRollout records a version which could not be deployed, so the alias keeps its deployment
+func (cp *ControlPlane) failRollout(name, alias string, version int, err error) {
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	now := time.Now()
+	cp.rollouts.latest[name] = &rollout{
+		Rollout: Rollout{
+			Function:   name,
+			Alias:      alias,
+			ToVersion:  version,
+			Phase:      RolloutFailed,
+			StartedAt:  now,
+			FinishedAt: now,
+			Error:      err.Error(),
+		},
+	}
+}
+
+// drainContainers removes replaced containers of a deployment once they served their last session or the grace
+// period passed, the rproxy must not hand out new sessions to them anymore
+func (cp *ControlPlane) drainContainers(uniqueName string, handler Handler, ips []string) {
+	now := time.Now()
+	r := &rollout{
+		Rollout: Rollout{
+			Function:  handler.State().Name,
+			From:      uniqueName,
+			Phase:     RolloutDraining,
+			StartedAt: now,
+			Deadline:  now.Add(cp.DrainGrace),
+		},
+		old:        handler,
+		containers: ips,
+		abort:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	cp.rollouts.drains[r] = struct{}{}
+	cp.rollouts.wg.Add(1)
+	go cp.drain(r)
+}
+
+// drain waits until the old deployment of a rollout, or its replaced containers, served the last session or the
+// grace period passed. Then the old deployment is removed from the rproxy and destroyed, or only the replaced containers are removed.
+func (cp *ControlPlane) drain(r *rollout) {
+	defer cp.rollouts.wg.Done()
+	defer close(r.done)
+
+	if len(r.containers) > 0 {
+		log.Printf("draining containers %v of deployment %s of function %s until %v", r.containers, r.From, r.Function, r.Deadline)
+	} else {
+		log.Printf("draining deployment %s of function %s until %v", r.From, r.Function, r.Deadline)
+	}
+
+	ticker := time.NewTicker(DrainPollInterval)
+	defer ticker.Stop()
+
+	deadline := time.NewTimer(time.Until(r.Deadline))
+	defer deadline.Stop()
+
+	phase := RolloutCompleted
+wait:
+	for {
+		select {
+		case <-r.abort:
+			phase = RolloutAborted
+			break wait
+		case <-deadline.C:
+			phase = RolloutExpired
+			break wait
+		case <-ticker.C:
+		}
+
+		sessions, err := cp.drainingSessions(r)
+		if err != nil {
+			// the rproxy might be restarting, the deadline still applies
+			log.Printf("not able to fetch the sessions of deployment %s: %v", r.From, err)
+			continue
+		}
+
+		cp.rollouts.mtx.Lock()
+		r.Sessions = sessions
+		cp.rollouts.mtx.Unlock()
+
+		if sessions == 0 {
+			break wait
+		}
+	}
+
+	var err error
+	if len(r.containers) > 0 {
+		err = cp.removeDrained(r, phase)
+	} else {
+		log.Printf("destroying deployment %s of function %s (%s)", r.From, r.Function, phase)
+		err = cp.deregisterAtRProxy(r.From, true)
+		if err != nil {
+			log.Printf("not able to deregister deployment %s at the rproxy: %v", r.From, err)
+		}
+
+		err = r.old.Destroy()
+	}
+
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	r.Phase = phase
+	r.FinishedAt = time.Now()
+	if err != nil {
+		log.Printf("not able to destroy deployment %s of function %s: %v", r.From, r.Function, err)
+		r.Error = err.Error()
+	}
+	delete(cp.rollouts.drains, r)
+}
+
+// drainingSessions returns the amount of sessions the old deployment of a rollout, or its replaced containers, still serve
+func (cp *ControlPlane) drainingSessions(r *rollout) (int, error) {
+	if len(r.containers) == 0 {
+		return cp.sessions(r.From)
+	}
+
+	status, err := cp.proxyStatus(r.From)
+	if err != nil {
+		return 0, err
+	}
+
+	// the rproxy keeps removed containers as draining until their session ended
+	sessions := 0
+	for _, ip := range r.containers {
+		if slices.Contains(status.Draining, ip) {
+			sessions++
+		}
+	}
+	return sessions, nil
+}
+
+// removeDrained removes the replaced containers of a drain from their deployment. After an abort the caller
+// destroys the whole deployment, a deployment which was retired in the meantime is left alone as well.
+func (cp *ControlPlane) removeDrained(r *rollout, phase RolloutPhase) error {
+	if phase == RolloutAborted {
+		return nil
+	}
+
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	if cp.FunctionHandlers[r.From] != r.old {
+		return nil
+	}
+
+	log.Printf("removing replaced containers %v of deployment %s (%s)", r.containers, r.From, phase)
+
+	var errs []error
+	for _, ip := range r.containers {
+		// e.g. evicted in the meantime
+		if !slices.Contains(r.old.IPs(), ip) {
+			continue
+		}
+
+		err := r.old.Delete(ip)
+		if err != nil {
+			log.Printf("not able to remove replaced container with ip %s of deployment %s: %v", ip, r.From, err)
+			errs = append(errs, err)
+		}
+	}
+
+	cp.persist(r.old)
+
+	return errors.Join(errs...)
+}
+
+// abortDrains destroys the old deployments of the function right away, which cuts off their sessions,
+// and waits until they are gone. Drains of replaced containers are only aborted, the caller holds
+// the lock of the function and destroys their deployments itself.
+func (cp *ControlPlane) abortDrains(name string) {
+	cp.rollouts.mtx.Lock()
+	aborted := make([]*rollout, 0)
+	for r := range cp.rollouts.drains {
+		if r.Function == name {
+			r.abortOnce.Do(func() { close(r.abort) })
+			if len(r.containers) == 0 {
+				aborted = append(aborted, r)
+			}
+		}
+	}
+	cp.rollouts.mtx.Unlock()
+
+	for _, r := range aborted {
+		<-r.done
+	}
+}
+
+// draining returns the unique names of the deployments of the function which are still draining
+func (cp *ControlPlane) draining(name string) []string {
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	uniqueNames := make([]string, 0)
+	for r := range cp.rollouts.drains {
+		if r.Function == name && len(r.containers) == 0 {
+			uniqueNames = append(uniqueNames, r.From)
+		}
+	}
+	return uniqueNames
+}
+
+// drainingVersion reports whether a deployment of the version of the function is still draining
+func (cp *ControlPlane) drainingVersion(name string, number int) bool {
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	for r := range cp.rollouts.drains {
+		if r.Function == name && len(r.containers) == 0 && r.FromVersion == number {
+			return true
+		}
+	}
+	return false
+}
+
+// stopDrains aborts every drain and waits until the old deployments are destroyed
+func (cp *ControlPlane) stopDrains() {
+	cp.rollouts.mtx.Lock()
+	for r := range cp.rollouts.drains {
+		r.abortOnce.Do(func() { close(r.abort) })
+	}
+	cp.rollouts.mtx.Unlock()
+
+	cp.rollouts.wg.Wait()
+}
+
+// Rollout returns the progress of the latest deployment of a function
+func (cp *ControlPlane) Rollout(name string) (Rollout, error) {
+	cp.rollouts.mtx.Lock()
+	defer cp.rollouts.mtx.Unlock()
+
+	r, ok := cp.rollouts.latest[name]
+	if !ok {
+		return Rollout{}, ErrFunctionNotFound
+	}
+
+	return r.Rollout, nil
+}
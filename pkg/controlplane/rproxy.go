@@ -0,0 +1,248 @@
+package controlplane
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// registerWithRetries registers a deployment at the rproxy, which might still be starting
+func (cp *ControlPlane) registerWithRetries(name string, uniqueName string, ips []string, config FunctionConfig) error {
+	var err error
+	for i := 0; i < RProxyRetries; i++ {
+		err = cp.registerAtRProxy(name, uniqueName, ips, config)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return err
+}
+
+// registerAtRProxy makes ips the containers of the deployment of the function name at the rproxy, the deployment
+// is added if needed. The rproxy settings of the config are applied on top of the defaults of the rproxy.
+func (cp *ControlPlane) registerAtRProxy(name string, uniqueName string, ips []string, config FunctionConfig) error {
+	// sessions on the deployment are authenticated with the credentials of the function
+	d := struct {
+		IPs      []string `json:"ips"`
+		Function string   `json:"function"`
+	}{
+		IPs:      ips,
+		Function: name,
+	}
+
+	_, err := cp.rproxyRequest(http.MethodPut, "/functions/"+url.PathEscape(uniqueName), d)
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]any)
+	if config.Strategy != "" {
+		settings["strategy"] = config.Strategy
+		settings["clientKey"] = config.ClientKey
+	}
+	if config.ResumeGrace != "" {
+		settings["resumeGrace"] = config.ResumeGrace
+	}
+	if config.Relay != "" {
+		settings["relay"] = config.Relay
+	}
+	for name, v := range map[string]string{"idleTimeout": config.Limits.IdleTimeout, "writeTimeout": config.Limits.WriteTimeout, "maxDuration": config.Limits.MaxDuration} {
+		if v != "" {
+			settings[name] = v
+		}
+	}
+	if config.Limits.MaxMessageSize > 0 {
+		settings["maxMessageSize"] = config.Limits.MaxMessageSize
+	}
+	if config.Limits.MaxBytes > 0 {
+		settings["maxBytes"] = config.Limits.MaxBytes
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+
+	_, err = cp.rproxyRequest(http.MethodPatch, "/functions/"+url.PathEscape(uniqueName)+"/settings", settings)
+	return err
+}
+
+// addEndpoints adds containers to a deployment registered at the rproxy
+func (cp *ControlPlane) addEndpoints(uniqueName string, ips []string) error {
+	_, err := cp.rproxyRequest(http.MethodPost, "/functions/"+url.PathEscape(uniqueName)+"/endpoints", endpoints(ips))
+	return err
+}
+
+// removeEndpoints removes containers from a deployment registered at the rproxy, containers
+// serving a session get no new sessions and are dropped by the rproxy once the session ends
+func (cp *ControlPlane) removeEndpoints(uniqueName string, ips []string) error {
+	_, err := cp.rproxyRequest(http.MethodDelete, "/functions/"+url.PathEscape(uniqueName)+"/endpoints", endpoints(ips))
+	return err
+}
+
+// routeBackend is a deployment of a route at the rproxy, it gets weight out of the sum of all weights of the sessions
+type routeBackend struct {
+	Backend string `json:"backend"`
+	Weight  int    `json:"weight"`
+}
+
+// setRoute routes new sessions on the route to the given deployments. If clientKey is set, the rproxy
+// keeps every client identified by this header or query parameter on the same deployment.
+func (cp *ControlPlane) setRoute(route string, backends []routeBackend, clientKey string) error {
+	d := struct {
+		Backends  []routeBackend `json:"backends"`
+		ClientKey string         `json:"clientKey,omitempty"`
+	}{
+		Backends:  backends,
+		ClientKey: clientKey,
+	}
+
+	_, err := cp.rproxyRequest(http.MethodPut, "/routes/"+route, d)
+	return err
+}
+
+// deleteRoute removes a route from the rproxy, a route the rproxy does not know is fine
+func (cp *ControlPlane) deleteRoute(route string) error {
+	status, err := cp.rproxyRequest(http.MethodDelete, "/routes/"+route, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// sessions asks the rproxy for the amount of sessions a deployment serves, 0 if the rproxy does not know it
+func (cp *ControlPlane) sessions(uniqueName string) (int, error) {
+	status, err := cp.proxyStatus(uniqueName)
+	if err != nil {
+		return 0, err
+	}
+
+	return status.Used, nil
+}
+
+// proxyStatus asks the rproxy for the status of a deployment, the zero status if the rproxy does not know it
+func (cp *ControlPlane) proxyStatus(uniqueName string) (ProxyStatus, error) {
+	resp, err := cp.rproxyGet("/functions/" + url.PathEscape(uniqueName))
+	if err != nil {
+		return ProxyStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ProxyStatus{}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return ProxyStatus{}, fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
+	}
+
+	var status ProxyStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return ProxyStatus{}, err
+	}
+
+	return status, nil
+}
+
+// deregisterAtRProxy removes the deployment from the rproxy, a deployment the rproxy does not know is fine
+func (cp *ControlPlane) deregisterAtRProxy(uniqueName string, force bool) error {
+	path := "/functions/" + url.PathEscape(uniqueName)
+	if force {
+		path += "?force=true"
+	}
+
+	status, err := cp.rproxyRequest(http.MethodDelete, path, nil)
+	if status == http.StatusNotFound {
+		log.Printf("rproxy does not know deployment %s, skipping deregistration", uniqueName)
+		return nil
+	}
+
+	return err
+}
+
+// endpoints is the body of the endpoint requests
+func endpoints(ips []string) any {
+	return struct {
+		IPs []string `json:"ips"`
+	}{
+		IPs: ips,
+	}
+}
+
+// rproxyRequest sends a request to the config endpoint of the rproxy, d is sent as JSON if not nil.
+// The status code is returned as well, so callers can handle expected failures.
+func (cp *ControlPlane) rproxyRequest(method, path string, d any) (int, error) {
+	var body bytes.Buffer
+	if d != nil {
+		err := json.NewEncoder(&body).Encode(d)
+		if err != nil {
+			log.Printf("failed to marshall the payload for the rproxy: %v", err)
+			return 0, err
+		}
+	}
+
+	log.Printf("telling rproxy: %s %s %s", method, path, body.String())
+
+	req, err := http.NewRequest(method, cp.rproxyURL(path), &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	cp.authorize(req)
+
+	resp, err := cp.rproxyClient.Do(req)
+	if err != nil {
+		log.Printf("error telling rproxy %s %s: %v", method, path, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.StatusCode, nil
+	case http.StatusConflict:
+		return resp.StatusCode, ErrFunctionBusy
+	}
+
+	log.Printf("received a not expected status code from rproxy: %d", resp.StatusCode)
+	return resp.StatusCode, fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
+}
+
+// rproxyGet sends a GET request to the config endpoint of the rproxy
+func (cp *ControlPlane) rproxyGet(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, cp.rproxyURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	cp.authorize(req)
+
+	return cp.rproxyClient.Do(req)
+}
+
+// rproxyURL is the URL of a path on the config endpoint of the rproxy
+func (cp *ControlPlane) rproxyURL(path string) string {
+	scheme := "http"
+	if cp.rproxyTLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d%s", scheme, cp.rproxyListenAddr, cp.rproxyConfigPort, path)
+}
+
+// SetRProxyTLS makes the control plane call the config endpoint of the rproxy with TLS, config verifies the
+// certificate of the rproxy and may present a client certificate. It must be called before Restore.
+func (cp *ControlPlane) SetRProxyTLS(config *tls.Config) {
+	cp.rproxyTLS = true
+	cp.rproxyClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// authorize adds the internal credential to a request to the rproxy
+func (cp *ControlPlane) authorize(req *http.Request) {
+	if cp.RProxyToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cp.RProxyToken)
+	}
+}
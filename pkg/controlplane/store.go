@@ -0,0 +1,319 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FunctionState is the metadata of a deployment of a function which is needed to rebuild its handler after a restart
+type FunctionState struct {
+	Name string `json:"name"`
+	// UniqueName identifies the deployment, the rproxy knows it by this name
+	UniqueName string    `json:"uniqueName"`
+	Version    int       `json:"version"`
+	Image      string    `json:"image"`
+	Network    string    `json:"network"`
+	Containers []string  `json:"containers"`
+	IPs        []string  `json:"ips"`
+	DeployedAt time.Time `json:"deployedAt"`
+	FunctionConfig
+}
+
+// Store persists the state of the control plane, so it survives restarts
+type Store interface {
+	// ID returns the id of the control plane, an empty string if none has been stored yet
+	ID() (string, error)
+	SetID(id string) error
+	// Deployments returns the state of every deployment of every function
+	Deployments() ([]FunctionState, error)
+	PutDeployment(state FunctionState) error
+	DeleteDeployment(uniqueName string) error
+	// Functions returns the names of the functions with versions
+	Functions() ([]string, error)
+	// Versions returns the versions and aliases of a function, an empty history if there is none
+	Versions(name string) (VersionHistory, error)
+	PutVersions(history VersionHistory) error
+	// DeleteFunction removes the deployments, the versions and the secrets of a function
+	DeleteFunction(name string) error
+	// Secrets returns the secrets of a function, they are kept apart from its state
+	Secrets(name string) (map[string]string, error)
+	PutSecrets(name string, secrets map[string]string) error
+}
+
+// FileStore is a Store which keeps the complete state in a single JSON file,
+// secrets are written to a second file which is only readable by the owner
+type FileStore struct {
+	path        string
+	secretsPath string
+	mtx         sync.Mutex
+}
+
+type fileStoreContent struct {
+	ID string `json:"id"`
+	// Deployments by their uniqueName
+	Deployments map[string]FunctionState `json:"deployments"`
+	// Versions by function name
+	Versions map[string]VersionHistory `json:"versions"`
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := filepath.Ext(path)
+
+	return &FileStore{
+		path:        path,
+		secretsPath: strings.TrimSuffix(path, ext) + ".secrets" + ext,
+	}, nil
+}
+
+func (s *FileStore) ID() (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return "", err
+	}
+
+	return c.ID, nil
+}
+
+func (s *FileStore) SetID(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	c.ID = id
+	return s.write(c)
+}
+
+func (s *FileStore) Deployments() ([]FunctionState, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	deployments := make([]FunctionState, 0, len(c.Deployments))
+	for _, d := range c.Deployments {
+		deployments = append(deployments, d)
+	}
+
+	return deployments, nil
+}
+
+func (s *FileStore) PutDeployment(state FunctionState) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	c.Deployments[state.UniqueName] = state
+	return s.write(c)
+}
+
+func (s *FileStore) DeleteDeployment(uniqueName string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	delete(c.Deployments, uniqueName)
+	return s.write(c)
+}
+
+func (s *FileStore) Functions() ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Sorted(maps.Keys(c.Versions)), nil
+}
+
+func (s *FileStore) Versions(name string) (VersionHistory, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return VersionHistory{}, err
+	}
+
+	h, ok := c.Versions[name]
+	if !ok {
+		return NewVersionHistory(name), nil
+	}
+
+	if h.Aliases == nil {
+		h.Aliases = make(map[string]int)
+	}
+
+	return h, nil
+}
+
+func (s *FileStore) PutVersions(history VersionHistory) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	c.Versions[history.Name] = history
+	return s.write(c)
+}
+
+func (s *FileStore) DeleteFunction(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	maps.DeleteFunc(c.Deployments, func(_ string, d FunctionState) bool {
+		return d.Name == name
+	})
+	delete(c.Versions, name)
+	err = s.write(c)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := s.readSecrets()
+	if err != nil {
+		return err
+	}
+
+	delete(secrets, name)
+	return s.writeFile(s.secretsPath, secrets, 0600)
+}
+
+func (s *FileStore) Secrets(name string) (map[string]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	secrets, err := s.readSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	if secrets[name] == nil {
+		return make(map[string]string), nil
+	}
+
+	return secrets[name], nil
+}
+
+func (s *FileStore) PutSecrets(name string, secrets map[string]string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	all, err := s.readSecrets()
+	if err != nil {
+		return err
+	}
+
+	all[name] = secrets
+	return s.writeFile(s.secretsPath, all, 0600)
+}
+
+func (s *FileStore) read() (*fileStoreContent, error) {
+	c := &fileStoreContent{
+		Deployments: make(map[string]FunctionState),
+		Versions:    make(map[string]VersionHistory),
+	}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Deployments == nil {
+		c.Deployments = make(map[string]FunctionState)
+	}
+
+	if c.Versions == nil {
+		c.Versions = make(map[string]VersionHistory)
+	}
+
+	return c, nil
+}
+
+// readSecrets returns the secrets of all functions by function name
+func (s *FileStore) readSecrets() (map[string]map[string]string, error) {
+	secrets := make(map[string]map[string]string)
+
+	b, err := os.ReadFile(s.secretsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+func (s *FileStore) write(c *fileStoreContent) error {
+	return s.writeFile(s.path, c, 0644)
+}
+
+// writeFile replaces the file atomically, so a crash never leaves a half written state behind
+func (s *FileStore) writeFile(path string, v any, perm os.FileMode) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,135 @@
+package controlplane
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The state and the secrets are read back by a new store on the same path, like after a restart
+func TestFileStoreRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "aube.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetID("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutDeployment(FunctionState{Name: "echo", UniqueName: "echo-1", Version: 1, IPs: []string{"10.0.0.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutVersions(VersionHistory{Name: "echo", Versions: []Version{{Number: 1, Image: "echo-image-1"}}, Aliases: map[string]int{"prod": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutSecrets("echo", map[string]string{"TOKEN": "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := restarted.ID()
+	if err != nil || id != "test" {
+		t.Fatalf("expected id test, got %q, %v", id, err)
+	}
+	deployments, err := restarted.Deployments()
+	if err != nil || len(deployments) != 1 || deployments[0].UniqueName != "echo-1" || deployments[0].IPs[0] != "10.0.0.2" {
+		t.Fatalf("expected the deployment echo-1, got %v, %v", deployments, err)
+	}
+	history, err := restarted.Versions("echo")
+	if err != nil || len(history.Versions) != 1 || history.Aliases["prod"] != 1 {
+		t.Fatalf("expected version 1 with alias prod, got %v, %v", history, err)
+	}
+	secrets, err := restarted.Secrets("echo")
+	if err != nil || secrets["TOKEN"] != "hunter2" {
+		t.Fatalf("expected the secret TOKEN, got %v, %v", secrets, err)
+	}
+}
+
+// Secrets are kept out of the state file in a file only the owner can read
+func TestFileStoreSecretsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aube.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.PutDeployment(FunctionState{Name: "echo", UniqueName: "echo-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutSecrets("echo", map[string]string{"TOKEN": "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "hunter2") {
+		t.Fatalf("expected the secret not to be in the state file")
+	}
+
+	info, err := os.Stat(filepath.Join(filepath.Dir(path), "aube.secrets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected the secrets file to have mode 0600, got %v", perm)
+	}
+}
+
+// Deleting a function removes its deployments, versions and secrets, but keeps the other functions
+func TestFileStoreDeleteFunction(t *testing.T) {
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "aube.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"echo", "chat"} {
+		err = s.PutDeployment(FunctionState{Name: name, UniqueName: name + "-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.PutVersions(VersionHistory{Name: name, Versions: []Version{{Number: 1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.PutSecrets(name, map[string]string{"TOKEN": name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.DeleteFunction("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployments, _ := s.Deployments()
+	if len(deployments) != 1 || deployments[0].Name != "chat" {
+		t.Fatalf("expected only the deployment of chat, got %v", deployments)
+	}
+	functions, _ := s.Functions()
+	if len(functions) != 1 || functions[0] != "chat" {
+		t.Fatalf("expected only the function chat, got %v", functions)
+	}
+	secrets, _ := s.Secrets("echo")
+	if len(secrets) != 0 {
+		t.Fatalf("expected the secrets of echo to be removed, got %v", secrets)
+	}
+	secrets, _ = s.Secrets("chat")
+	if secrets["TOKEN"] != "chat" {
+		t.Fatalf("expected the secrets of chat to be kept, got %v", secrets)
+	}
+}
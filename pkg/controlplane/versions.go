@@ -0,0 +1,547 @@
+package controlplane
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAlias always points to the most recently uploaded version, the rproxy routes /<name> to it
+	DefaultAlias = "latest"
+	// DefaultImageRetention is the amount of the newest versions without an alias whose images are kept for a rollback
+	DefaultImageRetention = 3
+)
+
+var (
+	// ErrVersionNotFound is returned if a function has no version with the given number
+	ErrVersionNotFound = errors.New("version not found")
+	// ErrInvalidName is returned for function or alias names the rproxy can't route on
+	ErrInvalidName = errors.New("invalid name")
+	// ErrVersionPruned is returned if a version should be deployed whose image was pruned
+	ErrVersionPruned = errors.New("image of the version was pruned")
+)
+
+// Version is an immutable build of a function, every upload creates a new one
+type Version struct {
+	Number int    `json:"number"`
+	Image  string `json:"image"`
+	// ZipHash is the hex encoded SHA-256 of the uploaded zip
+	ZipHash string         `json:"zipHash"`
+	BuiltAt time.Time      `json:"builtAt"`
+	Config  FunctionConfig `json:"config"`
+	// Pruned is set once the image of the version was removed, the version can't be deployed anymore
+	Pruned bool `json:"pruned,omitempty"`
+}
+
+// VersionHistory are all versions of a function and the aliases pointing to them
+type VersionHistory struct {
+	Name     string    `json:"name"`
+	Versions []Version `json:"versions"`
+	// Aliases map the alias name to a version number
+	Aliases map[string]int `json:"aliases"`
+	// Canaries map the alias name to the canary release of the alias, if it has one
+	Canaries map[string]Canary `json:"canaries,omitempty"`
+}
+
+// Canary sends a share of the sessions of an alias to another version, so the version can be judged
+// before the alias is pointed to it
+type Canary struct {
+	Version int `json:"version"`
+	// Weight is the percentage of the sessions of the alias the canary gets
+	Weight int `json:"weight"`
+	// ClientKey is the header or query parameter identifying a client, every session of a client goes to the same version
+	ClientKey string `json:"clientKey,omitempty"`
+}
+
+func NewVersionHistory(name string) VersionHistory {
+	return VersionHistory{
+		Name:     name,
+		Versions: make([]Version, 0),
+		Aliases:  make(map[string]int),
+		Canaries: make(map[string]Canary),
+	}
+}
+
+func (h VersionHistory) version(number int) (Version, bool) {
+	idx := slices.IndexFunc(h.Versions, func(v Version) bool { return v.Number == number })
+	if idx < 0 {
+		return Version{}, false
+	}
+	return h.Versions[idx], true
+}
+
+func (h VersionHistory) next() int {
+	if len(h.Versions) == 0 {
+		return 1
+	}
+	return h.Versions[len(h.Versions)-1].Number + 1
+}
+
+// referenced reports whether any alias or canary points to the version
+func (h VersionHistory) referenced(number int) bool {
+	for _, n := range h.Aliases {
+		if n == number {
+			return true
+		}
+	}
+	for _, c := range h.Canaries {
+		if c.Version == number {
+			return true
+		}
+	}
+	return false
+}
+
+// validName reports whether name can be used as function or alias name, they become part of the rproxy path
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/@?# ")
+}
+
+// routeName is the path the rproxy serves an alias of a function on, the default alias is served on the function name
+func routeName(name, alias string) string {
+	if alias == DefaultAlias {
+		return name
+	}
+	return name + "/" + alias
+}
+
+// Versions returns the versions and aliases of a function
+func (cp *ControlPlane) Versions(name string) (VersionHistory, error) {
+	h, err := cp.store.Versions(name)
+	if err != nil {
+		return VersionHistory{}, err
+	}
+
+	if len(h.Versions) == 0 {
+		return VersionHistory{}, ErrFunctionNotFound
+	}
+
+	return h, nil
+}
+
+// SetAlias points an alias of a function to one of its versions, e.g. to roll back to an earlier version.
+// The version is deployed from its image if no other alias runs it yet, nothing is rebuilt.
+func (cp *ControlPlane) SetAlias(name, alias string, number int) error {
+	log.Printf("pointing alias %s of function %s to version %d", alias, name, number)
+	if cp.stopping.Load() {
+		return ErrShuttingDown
+	}
+
+	if !validName(alias) {
+		return fmt.Errorf("%w: alias %q", ErrInvalidName, alias)
+	}
+
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	h, err := cp.Versions(name)
+	if err != nil {
+		return err
+	}
+
+	return cp.pointAlias(&h, alias, number)
+}
+
+// DeleteAlias removes an alias of a function, the default alias can't be removed.
+// The version it pointed to drains if no other alias points to it.
+func (cp *ControlPlane) DeleteAlias(name, alias string) error {
+	log.Printf("removing alias %s of function %s", alias, name)
+
+	if alias == DefaultAlias {
+		return fmt.Errorf("%w: the %s alias can't be removed", ErrInvalidName, DefaultAlias)
+	}
+
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	h, err := cp.Versions(name)
+	if err != nil {
+		return err
+	}
+
+	number, ok := h.Aliases[alias]
+	if !ok {
+		return ErrFunctionNotFound
+	}
+
+	err = cp.deleteRoute(routeName(name, alias))
+	if err != nil {
+		return err
+	}
+
+	canary, hasCanary := h.Canaries[alias]
+	delete(h.Aliases, alias)
+	delete(h.Canaries, alias)
+	err = cp.store.PutVersions(h)
+	if err != nil {
+		return err
+	}
+
+	cp.drainUnreferenced(&h, alias, number, nil)
+	if hasCanary {
+		cp.drainUnreferenced(&h, alias, canary.Version, nil)
+	}
+	cp.pruneImages(&h)
+
+	return nil
+}
+
+// SetCanary sends weight percent of the sessions of an alias to another version of the function,
+// the version is deployed if needed. An existing canary of the alias is replaced. Pointing the alias
+// to the version of its canary with SetAlias promotes the canary.
+func (cp *ControlPlane) SetCanary(name, alias string, canary Canary) error {
+	log.Printf("sending %d%% of the sessions of alias %s of function %s to version %d", canary.Weight, alias, name, canary.Version)
+	if cp.stopping.Load() {
+		return ErrShuttingDown
+	}
+
+	if canary.Weight < 1 || canary.Weight > 99 {
+		return fmt.Errorf("%w: weight of the canary must be between 1 and 99", ErrInvalidConfig)
+	}
+
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	h, err := cp.Versions(name)
+	if err != nil {
+		return err
+	}
+
+	number, ok := h.Aliases[alias]
+	if !ok {
+		return ErrFunctionNotFound
+	}
+
+	if canary.Version == number {
+		return fmt.Errorf("%w: alias %s already points to version %d", ErrInvalidConfig, alias, number)
+	}
+
+	main, err := cp.ensureDeployed(&h, number)
+	if err != nil {
+		return err
+	}
+
+	target, err := cp.ensureDeployed(&h, canary.Version)
+	if err != nil {
+		log.Printf("deploying canary version %d of function %s failed, alias %s is unchanged: %v", canary.Version, name, alias, err)
+		cp.failRollout(name, alias, canary.Version, err)
+		return err
+	}
+
+	if h.Canaries == nil {
+		h.Canaries = make(map[string]Canary)
+	}
+	prev, hadPrev := h.Canaries[alias]
+	h.Canaries[alias] = canary
+
+	err = cp.routeAlias(&h, alias, main)
+	if err != nil {
+		return err
+	}
+
+	err = cp.store.PutVersions(h)
+	if err != nil {
+		log.Printf("not able to persist the versions of function %s: %v", name, err)
+	}
+
+	if hadPrev && prev.Version == canary.Version {
+		return nil
+	}
+
+	var old Handler
+	if hadPrev {
+		old = cp.drainable(&h, prev.Version)
+	}
+	cp.startRollout(name, alias, old, target)
+	cp.pruneImages(&h)
+
+	return nil
+}
+
+// DeleteCanary routes every session of an alias to its version again, the canary version drains
+// if nothing else points to it
+func (cp *ControlPlane) DeleteCanary(name, alias string) error {
+	log.Printf("removing the canary of alias %s of function %s", alias, name)
+
+	unlock := cp.lockFunction(name)
+	defer unlock()
+
+	h, err := cp.Versions(name)
+	if err != nil {
+		return err
+	}
+
+	canary, ok := h.Canaries[alias]
+	if !ok {
+		return ErrFunctionNotFound
+	}
+
+	main, err := cp.ensureDeployed(&h, h.Aliases[alias])
+	if err != nil {
+		return err
+	}
+
+	delete(h.Canaries, alias)
+
+	err = cp.routeAlias(&h, alias, main)
+	if err != nil {
+		return err
+	}
+
+	err = cp.store.PutVersions(h)
+	if err != nil {
+		log.Printf("not able to persist the versions of function %s: %v", name, err)
+	}
+
+	cp.drainUnreferenced(&h, alias, canary.Version, main)
+	cp.pruneImages(&h)
+
+	return nil
+}
+
+// pointAlias deploys the version if needed, routes the alias to it and drains the deployment of the
+// version the alias pointed to before, unless another alias still needs it. the function must be locked.
+func (cp *ControlPlane) pointAlias(h *VersionHistory, alias string, number int) error {
+	target, err := cp.ensureDeployed(h, number)
+	if errors.Is(err, ErrVersionNotFound) {
+		return err
+	} else if err != nil {
+		log.Printf("deploying version %d of function %s failed, alias %s is unchanged: %v", number, h.Name, alias, err)
+		cp.failRollout(h.Name, alias, number, err)
+		return err
+	}
+
+	prev, hadPrev := h.Aliases[alias]
+	h.Aliases[alias] = number
+
+	// pointing the alias to the version of its canary promotes the canary
+	if c, ok := h.Canaries[alias]; ok && c.Version == number {
+		delete(h.Canaries, alias)
+	}
+
+	// new sessions on the alias go to the target from now on
+	err = cp.routeAlias(h, alias, target)
+	if err != nil {
+		if hadPrev {
+			h.Aliases[alias] = prev
+		} else {
+			delete(h.Aliases, alias)
+		}
+		return err
+	}
+
+	err = cp.store.PutVersions(*h)
+	if err != nil {
+		log.Printf("not able to persist the versions of function %s: %v", h.Name, err)
+	}
+
+	cp.pruneImages(h)
+
+	// e.g. on restore, nothing changed
+	if hadPrev && prev == number {
+		return nil
+	}
+
+	var old Handler
+	if hadPrev {
+		old = cp.drainable(h, prev)
+	}
+	cp.startRollout(h.Name, alias, old, target)
+
+	return nil
+}
+
+// routeAlias routes the sessions of an alias to the deployment of its version and, if the alias has a canary,
+// a share of them to the deployment of the canary version. the function must be locked
+func (cp *ControlPlane) routeAlias(h *VersionHistory, alias string, main Handler) error {
+	backends := []routeBackend{{Backend: main.State().UniqueName, Weight: 100}}
+	clientKey := ""
+
+	if c, ok := h.Canaries[alias]; ok {
+		canary := cp.deployment(h.Name, c.Version)
+		if canary != nil {
+			backends[0].Weight = 100 - c.Weight
+			backends = append(backends, routeBackend{Backend: canary.State().UniqueName, Weight: c.Weight})
+			clientKey = c.ClientKey
+		} else {
+			log.Printf("canary version %d of alias %s of function %s is not deployed, routing every session to version %d", c.Version, alias, h.Name, h.Aliases[alias])
+		}
+	}
+
+	return cp.setRoute(routeName(h.Name, alias), backends, clientKey)
+}
+
+// ensureDeployed returns the deployment of a version and deploys the version if it is not running yet.
+// The function must be locked
+func (cp *ControlPlane) ensureDeployed(h *VersionHistory, number int) (Handler, error) {
+	v, ok := h.version(number)
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+
+	if handler := cp.deployment(h.Name, number); handler != nil {
+		return handler, nil
+	}
+
+	if v.Pruned {
+		return nil, fmt.Errorf("%w: version %d of function %s", ErrVersionPruned, number, h.Name)
+	}
+
+	secrets, err := cp.store.Secrets(h.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp.deploy(h.Name, v, secrets)
+}
+
+// drainable retires the deployment of a version nothing points to anymore and returns it, so it can be drained.
+// nil is returned if the version is still needed or not deployed. the function must be locked
+func (cp *ControlPlane) drainable(h *VersionHistory, number int) Handler {
+	if h.referenced(number) {
+		return nil
+	}
+
+	old := cp.deployment(h.Name, number)
+	if old != nil {
+		cp.retire(old)
+	}
+	return old
+}
+
+// drainUnreferenced drains the deployment of a version an alias stopped pointing to, if nothing else points to it.
+// The function must be locked
+func (cp *ControlPlane) drainUnreferenced(h *VersionHistory, alias string, number int, new Handler) {
+	if old := cp.drainable(h, number); old != nil {
+		cp.startRollout(h.Name, alias, old, new)
+	}
+}
+
+// pruneImages removes the images of the versions no alias or canary points to, except for the ImageRetention newest
+// ones which are kept for a rollback. Versions which still run or drain are pruned on a later change. The function must be locked
+func (cp *ControlPlane) pruneImages(h *VersionHistory) {
+	kept := 0
+	pruned := false
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		v := &h.Versions[i]
+		if v.Pruned || h.referenced(v.Number) {
+			continue
+		}
+
+		if kept < cp.ImageRetention {
+			kept++
+			continue
+		}
+
+		if cp.deployment(h.Name, v.Number) != nil || cp.drainingVersion(h.Name, v.Number) {
+			continue
+		}
+
+		err := cp.backend.RemoveImage(v.Image)
+		if err != nil {
+			log.Printf("not able to prune image %s of version %d of function %s: %v", v.Image, v.Number, h.Name, err)
+			continue
+		}
+
+		log.Printf("pruned image %s of version %d of function %s", v.Image, v.Number, h.Name)
+		v.Pruned = true
+		pruned = true
+	}
+
+	if !pruned {
+		return
+	}
+
+	err := cp.store.PutVersions(*h)
+	if err != nil {
+		log.Printf("not able to persist the versions of function %s: %v", h.Name, err)
+	}
+}
+
+// deploy starts the containers of a version and registers them at the rproxy, the function must be locked
+func (cp *ControlPlane) deploy(name string, v Version, secrets map[string]string) (Handler, error) {
+	v.Config.Trusted = cp.trusted(name)
+
+	handler, err := cp.backend.Deploy(name, v, secrets)
+	if err != nil {
+		log.Printf("creating the function handler failed with err: %v", err)
+		return nil, err
+	}
+
+	uniqueName := handler.State().UniqueName
+	log.Printf("deploying version %d of function %s as %s", v.Number, name, uniqueName)
+
+	err = handler.Start()
+	if err == nil {
+		err = cp.registerAtRProxy(name, uniqueName, handler.IPs(), v.Config)
+	}
+	if err != nil {
+		destroyErr := handler.Destroy()
+		if destroyErr != nil {
+			log.Printf("not able to destroy failed deployment %s: %v", uniqueName, destroyErr)
+		}
+		return nil, err
+	}
+
+	// Stop destroys the active deployments, one which is added afterward would be left behind
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	if cp.stopping.Load() {
+		err = handler.Destroy()
+		if err != nil {
+			log.Printf("not able to destroy deployment %s: %v", uniqueName, err)
+		}
+		return nil, ErrShuttingDown
+	}
+
+	cp.FunctionHandlers[uniqueName] = handler
+	cp.persist(handler)
+
+	return handler, nil
+}
+
+// retire takes a deployment out of the active ones, so it can be drained. the function must be locked
+func (cp *ControlPlane) retire(handler Handler) {
+	uniqueName := handler.State().UniqueName
+	cp.functionHandlerMtx.Lock()
+	delete(cp.FunctionHandlers, uniqueName)
+	cp.functionHandlerMtx.Unlock()
+
+	err := cp.store.DeleteDeployment(uniqueName)
+	if err != nil {
+		log.Printf("not able to remove deployment %s from the store: %v", uniqueName, err)
+	}
+}
+
+// deployment returns the active deployment of a version, nil if the version is not deployed
+func (cp *ControlPlane) deployment(name string, number int) Handler {
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	for _, handler := range cp.FunctionHandlers {
+		state := handler.State()
+		if state.Name == name && state.Version == number {
+			return handler
+		}
+	}
+	return nil
+}
+
+// deployments returns the active deployments of a function by their uniqueName
+func (cp *ControlPlane) deployments(name string) map[string]Handler {
+	cp.functionHandlerMtx.Lock()
+	defer cp.functionHandlerMtx.Unlock()
+
+	deployments := make(map[string]Handler)
+	for uniqueName, handler := range cp.FunctionHandlers {
+		if handler.State().Name == name {
+			deployments[uniqueName] = handler
+		}
+	}
+	return deployments
+}
@@ -0,0 +1,202 @@
+package controlplane
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// deployed returns the uniqueName of the active deployment of a version, the test fails if it is not deployed
+func deployed(t *testing.T, cp *ControlPlane, name string, number int) string {
+	t.Helper()
+
+	handler := cp.deployment(name, number)
+	if handler == nil {
+		t.Fatalf("expected version %d of function %s to be deployed", number, name)
+	}
+	return handler.State().UniqueName
+}
+
+// Pointing an alias to an earlier version deploys it from its image and drains the version the alias pointed to
+func TestSetAliasRollback(t *testing.T) {
+	cp, backend, proxy := newTestControlPlane(t)
+	putVersions(t, cp, "echo", 1, 2)
+
+	err := cp.SetAlias("echo", DefaultAlias, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := deployed(t, cp, "echo", 2)
+
+	err = cp.SetAlias("echo", DefaultAlias, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := deployed(t, cp, "echo", 1)
+
+	if route := proxy.route("echo"); !slices.Equal(route, []routeBackend{{Backend: first, Weight: 100}}) {
+		t.Fatalf("expected the alias to be routed to %s, got %v", first, route)
+	}
+
+	if cp.deployment("echo", 2) != nil {
+		t.Fatal("expected version 2 to be retired")
+	}
+	cp.rollouts.wg.Wait()
+
+	backend.mtx.Lock()
+	destroyed := backend.handlers[second].destroyed
+	backend.mtx.Unlock()
+	if !destroyed {
+		t.Fatal("expected the deployment of version 2 to be destroyed once drained")
+	}
+
+	h, err := cp.Versions("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Aliases[DefaultAlias] != 1 {
+		t.Fatalf("expected the alias to point to version 1, got %v", h.Aliases)
+	}
+}
+
+func TestSetAliasUnknownVersion(t *testing.T) {
+	cp, _, _ := newTestControlPlane(t)
+	putVersions(t, cp, "echo", 1)
+
+	err := cp.SetAlias("echo", "prod", 2)
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrVersionNotFound, err)
+	}
+
+	err = cp.SetAlias("echo", "prod/v2", 1)
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected %v, got %v", ErrInvalidName, err)
+	}
+}
+
+// A canary gets its weight of the sessions of the alias, removing it routes every session to the version of the alias
+func TestCanaryWeights(t *testing.T) {
+	cp, _, proxy := newTestControlPlane(t)
+	putVersions(t, cp, "echo", 1, 2)
+
+	err := cp.SetAlias("echo", "prod", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := deployed(t, cp, "echo", 1)
+
+	err = cp.SetCanary("echo", "prod", Canary{Version: 2, Weight: 10, ClientKey: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary := deployed(t, cp, "echo", 2)
+
+	want := []routeBackend{{Backend: main, Weight: 90}, {Backend: canary, Weight: 10}}
+	if route := proxy.route("echo/prod"); !slices.Equal(route, want) {
+		t.Fatalf("expected the route %v, got %v", want, route)
+	}
+
+	err = cp.SetCanary("echo", "prod", Canary{Version: 1, Weight: 10})
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected a canary of the version of the alias to be rejected, got %v", err)
+	}
+
+	err = cp.DeleteCanary("echo", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if route := proxy.route("echo/prod"); !slices.Equal(route, []routeBackend{{Backend: main, Weight: 100}}) {
+		t.Fatalf("expected every session to go to %s, got %v", main, route)
+	}
+	if cp.deployment("echo", 2) != nil {
+		t.Fatal("expected the canary version to be retired")
+	}
+}
+
+// Pointing the alias to the version of its canary promotes the canary
+func TestCanaryPromote(t *testing.T) {
+	cp, _, proxy := newTestControlPlane(t)
+	putVersions(t, cp, "echo", 1, 2)
+
+	err := cp.SetAlias("echo", DefaultAlias, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cp.SetCanary("echo", DefaultAlias, Canary{Version: 2, Weight: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cp.SetAlias("echo", DefaultAlias, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := cp.Versions("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.Canaries[DefaultAlias]; ok {
+		t.Fatalf("expected the canary to be promoted, got %v", h.Canaries)
+	}
+
+	want := []routeBackend{{Backend: deployed(t, cp, "echo", 2), Weight: 100}}
+	if route := proxy.route("echo"); !slices.Equal(route, want) {
+		t.Fatalf("expected the route %v, got %v", want, route)
+	}
+}
+
+// Only the images of the ImageRetention newest versions without an alias are kept
+func TestPruneImages(t *testing.T) {
+	cp, backend, _ := newTestControlPlane(t)
+	cp.ImageRetention = 1
+
+	// every upload adds a version and points the alias to it
+	for number := 1; number <= 4; number++ {
+		putVersions(t, cp, "echo", number)
+		err := cp.SetAlias("echo", DefaultAlias, number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp.rollouts.wg.Wait()
+	}
+
+	// the last drain ended after the alias changed
+	err := cp.SetAlias("echo", DefaultAlias, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend.mtx.Lock()
+	removed := slices.Sorted(slices.Values(backend.removed))
+	backend.mtx.Unlock()
+
+	want := []string{fmt.Sprintf("echo-image-%d", 1), fmt.Sprintf("echo-image-%d", 2)}
+	if !slices.Equal(removed, want) {
+		t.Fatalf("expected the images %v to be pruned, got %v", want, removed)
+	}
+
+	h, err := cp.Versions("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range h.Versions {
+		if v.Pruned != (v.Number <= 2) {
+			t.Fatalf("unexpected pruned state of version %d: %v", v.Number, v.Pruned)
+		}
+	}
+
+	err = cp.SetAlias("echo", DefaultAlias, 1)
+	if !errors.Is(err, ErrVersionPruned) {
+		t.Fatalf("expected %v, got %v", ErrVersionPruned, err)
+	}
+
+	// the image of a version the alias points to is kept
+	err = cp.SetAlias("echo", "prod", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
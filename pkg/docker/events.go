@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"aube/pkg/controlplane"
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+)
+
+// Watch listens to the docker events of the containers of this AubeFaaS instance and reports those which die without
+// being stopped by a handler. Docker sends an oom event right before the die event of a container that ran out of memory.
+func (d DockerBackend) Watch(ctx context.Context, report func(controlplane.ContainerExit)) {
+	filters := make(client.Filters).
+		Add("type", string(events.ContainerEventType)).
+		Add("event", string(events.ActionOOM), string(events.ActionDie)).
+		Add("label", "AubeFaaS-ID="+d.id)
+
+	go func() {
+		// ids of containers which ran out of memory and did not die yet
+		oomKilled := make(map[string]bool)
+
+		for {
+			msgs, errs := d.client.Events(ctx, client.EventsListOptions{Filters: filters})
+
+		stream:
+			for {
+				select {
+				case m := <-msgs:
+					d.handleEvent(m, oomKilled, report)
+				case err := <-errs:
+					if ctx.Err() == nil {
+						log.Printf("docker event stream failed with err: %v, reconnecting", err)
+					}
+					break stream
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func (d DockerBackend) handleEvent(m events.Message, oomKilled map[string]bool, report func(controlplane.ContainerExit)) {
+	id := m.Actor.ID
+
+	switch m.Action {
+	case events.ActionOOM:
+		oomKilled[id] = true
+	case events.ActionDie:
+		oom := oomKilled[id]
+		delete(oomKilled, id)
+
+		if _, ok := d.stopping.LoadAndDelete(id); ok {
+			return
+		}
+
+		exitCode, err := strconv.Atoi(m.Actor.Attributes["exitCode"])
+		if err != nil {
+			exitCode = -1
+		}
+
+		report(controlplane.ContainerExit{
+			Function:  functionName(m.Actor.Attributes["AubeFaaS-Function"]),
+			Container: id,
+			ExitCode:  exitCode,
+			OOMKilled: oom,
+			Time:      time.Unix(0, m.TimeNano),
+		})
+	}
+}
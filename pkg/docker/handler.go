@@ -6,9 +6,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path"
@@ -25,121 +28,154 @@ import (
 
 const (
 	TmpDir = "./tmp"
+	// HealthPort is the port the runtime serves /health on
+	HealthPort = 8080
+	// HealthTimeout bounds a single health probe
+	HealthTimeout = 3 * time.Second
+	// StartupProbes is how often a started container is probed, a second apart, before it counts as unhealthy
+	StartupProbes = 3
+	// UnprivilegedUser is the user (nobody) the containers of untrusted functions run as
+	UnprivilegedUser = "65534:65534"
+	// ScratchDir is the only writable path of a hardened container, it is backed by a tmpfs of ScratchSize
+	ScratchDir  = "/tmp"
+	ScratchSize = "64m"
 )
 
 type DockerBackend struct {
 	id     string
 	client *client.Client
+	// ids of containers which are stopped on purpose, so their exit is not reported
+	stopping *sync.Map
+	// seccompProfile is the JSON seccomp profile of hardened containers, empty uses the docker default
+	seccompProfile string
+	// earlierIDs are the ids of earlier instances whose resources Reconcile treats like its own, "*" matches every id
+	earlierIDs []string
 }
 
 // Each dockerHandler represents a single function with n containers
 type dockerHandler struct {
-	name        string
-	uniqueName  string // Determines Image and Network as well
-	initThreads int
-	maxThreads  int
-	filePath    string
+	name       string
+	uniqueName string // Determines Network and container names as well
+	image      string // image of the deployed version, shared by every deployment of the version
+	version    int
+	config     controlplane.FunctionConfig
+	secrets    map[string]string // injected like env, must never be logged or persisted with the state
+	deployedAt time.Time
 	// Docker specific stuff -> needed to create or remove containers
-	client          *client.Client
-	containers      []string
-	containerIPs    []string
+	client   *client.Client
+	stopping *sync.Map
+	// mtx guards containers, nextContainer, containerIPs, ipOf, secrets and containerConfig, containers
+	// may be started while the control plane works on the handler
+	mtx           sync.Mutex
+	containers    []string
+	nextContainer int // index of the next container, keeps container names unique after deletions
+	containerIPs  []string
+	// container id -> ip, kept after a container died and lost its ip
+	ipOf            map[string]string
 	network         string
 	containerConfig *container.Config
 	hostConfig      *container.HostConfig
 }
 
-func New(aubeFaaSID string) (*DockerBackend, error) {
+func New(aubeFaaSID string, seccompProfile string, earlierIDs []string) (*DockerBackend, error) {
 	id := "AubeFaaS-" + aubeFaaSID
 
+	earlier := make([]string, 0, len(earlierIDs))
+	for _, e := range earlierIDs {
+		if e != "*" {
+			e = "AubeFaaS-" + e
+		}
+		earlier = append(earlier, e)
+	}
+
 	c, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
 
 	return &DockerBackend{
-		id:     id,
-		client: c,
+		id:             id,
+		client:         c,
+		stopping:       &sync.Map{},
+		seccompProfile: seccompProfile,
+		earlierIDs:     earlier,
 	}, nil
 }
 
-// Create creates a new function with function-name: name in the file-directory
+// Build builds the image of a new version of the function with function-name: name from the file-directory
 // filedir must include ./fn.py and ./requirements -> this will be loaded into to the container
 // filedir would be: ./test/fn
-func (d DockerBackend) Create(name string, filedir string, initThreads int, maxThreads int) (controlplane.Handler, error) {
+// The returned image tag is <name>-<uuid>, the image is kept until RemoveImage is called
+func (d DockerBackend) Build(name string, filedir string, config controlplane.FunctionConfig) (string, error) {
 
-	// Create a new unique function name
+	runtimeDir := path.Join(runtimesDir, config.Runtime)
+	if _, err := fs.Stat(runtimes, runtimeDir); err != nil {
+		return "", fmt.Errorf("%w: runtime %s is not supported", controlplane.ErrInvalidConfig, config.Runtime)
+	}
+
+	// Create a new unique image name
 	uuid, err := uuid2.NewRandom()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	uniqueName := name + "-" + uuid.String()
-
-	handler := &dockerHandler{
-		name:         name,
-		uniqueName:   uniqueName,
-		client:       d.client,
-		initThreads:  initThreads,
-		maxThreads:   maxThreads,
-		containers:   make([]string, 0, maxThreads),
-		containerIPs: make([]string, 0, maxThreads),
-	}
+	image := name + "-" + uuid.String()
 
 	// Copy the Docker-Runtime into a folder
-	// cp runtimes/python/* ./tmp/<uniqueName>
-	handler.filePath = path.Join(TmpDir, handler.uniqueName) // mkdir <folder>
-	log.Printf("Create Folder: %s", handler.filePath)
+	// cp runtimes/<runtime>/* ./tmp/<image>
+	filePath := path.Join(TmpDir, image) // mkdir <folder>
+	log.Printf("Create Folder: %s", filePath)
 
-	err = os.MkdirAll(handler.filePath, 0777)
+	err = os.MkdirAll(filePath, 0777)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = util.CopyDirFromEmbed(runtimes, path.Join(runtimesDir, "python"), handler.filePath)
+	err = util.CopyDirFromEmbed(runtimes, runtimeDir, filePath)
 	if err != nil {
-		log.Printf("copying embed filesystem (python-runtime) into function failed with err: %v", err)
-		return nil, err
+		log.Printf("copying embed filesystem (%s-runtime) into function failed with err: %v", config.Runtime, err)
+		return "", err
 	}
 
 	// Copy function-code into the runtime
 	// cp <filedir> <folder>/fn
 
-	functionFilePath := path.Join(handler.filePath, "fn")
+	functionFilePath := path.Join(filePath, "fn")
 	log.Printf("Create functionFilePath: %s", functionFilePath)
 
 	err = os.MkdirAll(functionFilePath, 0777)
 	if err != nil {
 		log.Printf("creating folder for function failed with err: %v", err)
-		return nil, err
+		return "", err
 	}
 
 	err = util.CopyAll(filedir, functionFilePath)
 	if err != nil {
 		log.Printf("copying function code into fn-folder failed with err: %v", err)
-		return nil, err
+		return "", err
 	}
 
-	tar, err := archive.TarWithOptions(handler.filePath, &archive.TarOptions{})
+	tar, err := archive.TarWithOptions(filePath, &archive.TarOptions{})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	log.Printf("Created tar: %+v", tar)
 
 	imageBuildOpts := client.ImageBuildOptions{
-		Tags:       []string{handler.uniqueName}, // needed for identifying the image
+		Tags:       []string{image}, // needed for identifying the image
 		Dockerfile: "Dockerfile",
 		Remove:     true,
 		Labels: map[string]string{
-			"AubeFaaS-Function": handler.uniqueName,
+			"AubeFaaS-Function": image,
 			"AubeFaaS-ID":       d.id,
 		},
 	}
 
-	imageResp, err := handler.client.ImageBuild(context.Background(), tar, imageBuildOpts)
+	imageResp, err := d.client.ImageBuild(context.Background(), tar, imageBuildOpts)
 	if err != nil {
 		log.Printf("Building failed with error: %v", err)
-		return nil, err
+		return "", err
 	}
 	defer imageResp.Body.Close()
 	// Reading Body from Image Creation
@@ -148,6 +184,32 @@ func (d DockerBackend) Create(name string, filedir string, initThreads int, maxT
 		log.Println(scanner.Text())
 	}
 
+	return image, nil
+}
+
+// Deploy creates the network and the initial containers of a version of the function from its image.
+// Every deployment gets its own uniqueName, so several versions of a function can run side by side.
+func (d DockerBackend) Deploy(name string, version controlplane.Version, secrets map[string]string) (controlplane.Handler, error) {
+	uuid, err := uuid2.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &dockerHandler{
+		name:         name,
+		uniqueName:   name + "-" + uuid.String(),
+		image:        version.Image,
+		version:      version.Number,
+		client:       d.client,
+		stopping:     d.stopping,
+		config:       version.Config,
+		secrets:      secrets,
+		deployedAt:   time.Now(),
+		containers:   make([]string, 0, version.Config.MaxThreads),
+		containerIPs: make([]string, 0, version.Config.MaxThreads),
+		ipOf:         make(map[string]string),
+	}
+
 	networkOpts := client.NetworkCreateOptions{
 		Labels: map[string]string{
 			"AubeFaaS-Function": handler.name,
@@ -162,39 +224,173 @@ func (d DockerBackend) Create(name string, filedir string, initThreads int, maxT
 
 	handler.network = nw.ID
 
-	containerConfig := &container.Config{
-		Image: handler.uniqueName,
+	d.configure(handler)
+
+	handler.mtx.Lock()
+	_, err = createContainer(handler, handler.config.InitThreads, handler.config.MaxThreads)
+	handler.mtx.Unlock()
+	if err != nil {
+		// the image stays, only the resources of this deployment are removed
+		destroyErr := handler.Destroy()
+		if destroyErr != nil {
+			log.Printf("not able to clean up deployment %s: %v", handler.uniqueName, destroyErr)
+		}
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+// RemoveImage removes the image of a version, it fails while containers still use the image
+func (d DockerBackend) RemoveImage(image string) error {
+	_, err := d.client.ImageRemove(context.Background(), image, client.ImageRemoveOptions{})
+	if err != nil {
+		log.Printf("not able to remove image %s with err: %v", image, err)
+		return err
+	}
+	return nil
+}
+
+// configure sets the container and host config every container of the function is created with
+func (d DockerBackend) configure(handler *dockerHandler) {
+	handler.containerConfig = &container.Config{
+		Image: handler.image,
+		Env:   handler.env(),
 		Labels: map[string]string{
 			"AubeFaaS-Function": handler.uniqueName,
 			"AubeFaaS-ID":       d.id,
 		},
 	}
 
-	handler.containerConfig = containerConfig
-
-	hostConfig := &container.HostConfig{
+	handler.hostConfig = &container.HostConfig{
 		NetworkMode: container.NetworkMode(handler.uniqueName),
+		Resources:   resources(handler.config.Resources),
+	}
+
+	if !handler.config.Trusted {
+		d.harden(handler)
 	}
+}
 
-	handler.hostConfig = hostConfig
+// harden runs the containers of a function as an unprivileged user without any capabilities,
+// on a read-only root filesystem with a small tmpfs as scratch space
+func (d DockerBackend) harden(handler *dockerHandler) {
+	handler.containerConfig.User = UnprivilegedUser
 
-	err = createContainer(handler, initThreads)
-	if err != nil {
-		return nil, err
+	handler.hostConfig.ReadonlyRootfs = true
+	handler.hostConfig.Tmpfs = map[string]string{
+		ScratchDir: "rw,noexec,nosuid,nodev,size=" + ScratchSize,
 	}
+	handler.hostConfig.CapDrop = []string{"ALL"}
+	handler.hostConfig.SecurityOpt = []string{"no-new-privileges"}
 
-	return handler, nil
+	if d.seccompProfile != "" {
+		handler.hostConfig.SecurityOpt = append(handler.hostConfig.SecurityOpt, "seccomp="+d.seccompProfile)
+	}
+}
+
+// resources translates the limits of a function into the docker resources of its containers
+func resources(r controlplane.Resources) container.Resources {
+	res := container.Resources{
+		NanoCPUs:  int64(r.CPUs * 1e9),
+		CPUShares: r.CPUShares,
+		Memory:    r.MemoryMB * 1024 * 1024,
+	}
+
+	if r.MemorySwapMB > 0 {
+		res.MemorySwap = r.MemorySwapMB * 1024 * 1024
+	} else {
+		// -1 is unlimited swap, 0 the docker default
+		res.MemorySwap = r.MemorySwapMB
+	}
+
+	if r.Pids > 0 {
+		res.PidsLimit = &r.Pids
+	}
+
+	for _, u := range r.Ulimits {
+		res.Ulimits = append(res.Ulimits, &container.Ulimit{
+			Name: u.Name,
+			Soft: u.Soft,
+			Hard: u.Hard,
+		})
+	}
+
+	return res
+}
+
+// env returns the environment of the containers, secrets take precedence over env variables of the same name
+func (handler *dockerHandler) env() []string {
+	vars := maps.Clone(handler.config.Env)
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	maps.Copy(vars, handler.secrets)
+	// tells the functionhandler which function to call
+	vars["AUBE_ENTRYPOINT"] = handler.config.Entrypoint
+
+	env := make([]string, 0, len(vars))
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		env = append(env, k+"="+vars[k])
+	}
+
+	return env
+}
+
+// SetSecrets sets the secrets of the containers created from now on
+func (handler *dockerHandler) SetSecrets(secrets map[string]string) {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+
+	handler.secrets = secrets
+	handler.containerConfig.Env = handler.env()
+}
+
+// Replace starts a new container for each existing one, this temporarily exceeds maxThreads by up to
+// the amount of existing containers
+func (handler *dockerHandler) Replace() ([]string, error) {
+	handler.mtx.Lock()
+	old := len(handler.containers)
+	limit := handler.config.MaxThreads + old
+	handler.mtx.Unlock()
+
+	ips := make([]string, 0, old)
+
+	for range old {
+		handler.mtx.Lock()
+		created, err := createContainer(handler, 1, limit)
+		handler.mtx.Unlock()
+		if err != nil {
+			return ips, err
+		}
+		if len(created) == 0 {
+			return ips, controlplane.ErrMaxThreads
+		}
+
+		ip, err := handler.StartContainer(created[0])
+		if err != nil {
+			return ips, err
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
 }
 
-func createContainer(handler *dockerHandler, amount int) error {
+// createContainer creates up to amount containers without exceeding limit (usually maxThreads) containers in total
+// and returns their ids, handler.mtx must be held
+func createContainer(handler *dockerHandler, amount int, limit int) ([]string, error) {
 
-	if curr := len(handler.containers); (curr + amount) > handler.maxThreads {
-		amount = handler.maxThreads - curr
+	if curr := len(handler.containers); (curr + amount) > limit {
+		amount = max(limit-curr, 0)
 		log.Printf("Not able to create more than %d container because it would exceed the upper resource bound", amount)
 	}
 
+	created := make([]string, 0)
 	for i := 0; i < amount; i++ {
-		idx := len(handler.containers)
+		idx := handler.nextContainer
+		handler.nextContainer++
 
 		c, err := handler.client.ContainerCreate(
 			context.Background(),
@@ -205,43 +401,35 @@ func createContainer(handler *dockerHandler, amount int) error {
 			handler.uniqueName+fmt.Sprintf("-%d", idx),
 		)
 		if err != nil {
-			return err
+			return created, err
 		}
 		handler.containers = append(handler.containers, c.ID)
+		created = append(created, c.ID)
 	}
 
-	return nil
+	return created, nil
 }
 
-// Add allows that we can scale-out, this function adds a single new container.
+// Add allows that we can scale-out, this function adds a single new container and returns its id.
 // So for adding several instances Add must be called the desired amount of times.
 func (handler *dockerHandler) Add() (string, error) {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
 
-	prev := handler.containers
+	if len(handler.containers) >= handler.config.MaxThreads {
+		return "", controlplane.ErrMaxThreads
+	}
 
-	err := createContainer(handler, 1)
+	created, err := createContainer(handler, 1, handler.config.MaxThreads)
 	if err != nil {
 		return "", err
 	}
 
-	curr := handler.containers
-
-	slices.Sort(prev)
-	slices.Sort(curr)
-
-	var containerName string
-
-	for i := 0; i < len(prev); i++ {
-		if prev[i] != curr[i] {
-			containerName = curr[i]
-		}
-	}
-	containerName = curr[len(curr)-1]
-
-	return containerName, err
+	return created[0], nil
 }
 
-func (handler *dockerHandler) StartContainer(name string) error {
+// StartContainer starts a container created by Add and returns its ip once it is healthy
+func (handler *dockerHandler) StartContainer(name string) (string, error) {
 	log.Printf("starting container with name: %s", name)
 	wg := sync.WaitGroup{}
 
@@ -265,7 +453,8 @@ func (handler *dockerHandler) StartContainer(name string) error {
 
 	err := <-errChan
 	if err != nil {
-		return err
+		handler.discard(name)
+		return "", err
 	}
 
 	log.Printf("inspecting container: %s", name)
@@ -273,55 +462,102 @@ func (handler *dockerHandler) StartContainer(name string) error {
 	insp, err := handler.client.ContainerInspect(context.Background(), name)
 	if err != nil {
 		log.Printf("not able to inspect container %s with err: %v", name, err)
-		return err
+		handler.discard(name)
+		return "", err
 	}
 
 	log.Printf("networks of inspection of %s: %+v", name, insp.NetworkSettings.Networks)
 	ip := insp.NetworkSettings.Networks[handler.uniqueName].IPAddress.String()
+
+	err = handler.waitHealthy(name, ip)
+	if err != nil {
+		// an unhealthy container must never be handed to the rproxy
+		handler.discard(name)
+		return "", err
+	}
+
+	// the ip is only published once the container is healthy, until then it counts as created
+	handler.mtx.Lock()
 	log.Printf("inspected following ip: %s to containerIPs: %v", ip, handler.containerIPs)
 	handler.containerIPs = append(handler.containerIPs, ip)
+	handler.ipOf[insp.ID] = ip
 	log.Printf("added ip to ips now: %v", handler.containerIPs)
+	handler.mtx.Unlock()
 
-	retries := 3
+	return ip, nil
+}
 
-	for i := 0; i < retries; i++ {
-		if i == retries-1 {
-			log.Printf("Container not able to start with 3 retries, logs:")
-			logs, err := handler.getContainerLogs(name)
-			if err != nil {
-				log.Printf("error occured printing logs, aborting: %v", err)
-				return err
-			}
-			log.Print(logs)
-		}
+// discard removes a container which could not be started, so it does not count against maxThreads anymore
+func (handler *dockerHandler) discard(containerID string) {
+	handler.stopping.Store(containerID, true)
+	err := handler.client.ContainerRemove(context.Background(), containerID, client.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		log.Printf("not able to remove container %s which failed to start with err: %v, please remove manually", containerID, err)
+		return
+	}
 
-		time.Sleep(1)
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
 
-		// timeout of 3 seconds
-		client := http.Client{
-			Timeout: 3 * time.Second,
-		}
+	handler.containers = slices.DeleteFunc(handler.containers, func(c string) bool { return c == containerID })
+}
 
-		resp, err := client.Get("http://" + ip + ":8080/health")
-		if err != nil {
-			log.Println(err)
-			log.Println("retrying in 1 second")
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
+// waitHealthy probes a started container until it is healthy, the logs of a container which never gets healthy are printed
+func (handler *dockerHandler) waitHealthy(name string, ip string) error {
+	var err error
+	for i := 0; i < StartupProbes; i++ {
+		time.Sleep(1 * time.Second)
+
+		err = handler.Probe(ip)
+		if err == nil {
 			log.Println("container", ip, "is ready")
-			break
+			return nil
 		}
-		log.Println("container", ip, "is not ready yet, retrying in 1 second")
-		time.Sleep(1 * time.Second)
+		log.Printf("container %s is not ready yet: %v", ip, err)
+	}
+
+	log.Printf("Container %s not healthy after %d probes, logs:", name, StartupProbes)
+	logs, logErr := handler.getContainerLogs(name)
+	if logErr != nil {
+		log.Printf("error occured printing logs: %v", logErr)
+	} else {
+		log.Print(logs)
+	}
+
+	return fmt.Errorf("container %s did not become healthy: %w", name, err)
+}
+
+// Probe asks the runtime of the container with the ip whether it is healthy
+func (handler *dockerHandler) Probe(ip string) error {
+	client := http.Client{
+		Timeout: HealthTimeout,
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s:%d/health", ip, HealthPort))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check responded with status code %d", resp.StatusCode)
 	}
 
 	return nil
 }
 
+// ContainerIP returns the ip of a container of the deployment, empty if the container is not part of it
+func (handler *dockerHandler) ContainerIP(container string) string {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+
+	return handler.ipOf[container]
+}
+
 func (handler *dockerHandler) Start() error {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+
 	wg := sync.WaitGroup{}
 
 	// Is this important?
@@ -355,39 +591,47 @@ func (handler *dockerHandler) Start() error {
 		ip := insp.NetworkSettings.Networks[handler.uniqueName].IPAddress.String()
 		log.Printf("IP-Address of Container %v is: %s", c, ip)
 		handler.containerIPs = append(handler.containerIPs, ip)
+		handler.ipOf[c] = ip
 	}
 
-	log.Printf("FH: %v, This the list of ips fetched: %v", handler, handler.containerIPs)
-	return nil
+	log.Printf("FH: %s, This the list of ips fetched: %v", handler.uniqueName, handler.containerIPs)
+
+	// the deployment only counts as started once every container is healthy
+	errs := make([]error, len(handler.containers))
+	for i, c := range handler.containers {
+		wg.Add(1)
+		go func(i int, c string) {
+			defer wg.Done()
+			errs[i] = handler.waitHealthy(c, handler.ipOf[c])
+		}(i, c)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
-// Delete deletes a specific Container based on the given
+// Delete deletes a specific Container based on the given ip, it works for containers which died as well
 func (handler *dockerHandler) Delete(containerIP string) error {
+	handler.mtx.Lock()
 	if !slices.Contains(handler.containerIPs, containerIP) {
+		handler.mtx.Unlock()
 		return fmt.Errorf("containerIP: %s does not exist in List of containerIPs", containerIP)
 	}
 
 	containerID := ""
-	// Now we need to find the container which is represented by the containerIP
-	for _, c := range handler.containers {
-		inspect, err := handler.client.ContainerInspect(context.Background(), c)
-		if err != nil {
-			log.Printf("Failed to inspect container with id: %s ", c)
-			return err
-		}
-
-		for _, net := range inspect.NetworkSettings.Networks {
-			if net.IPAddress.String() == containerIP {
-				containerID = c
-				break
-			}
-		}
-
-		if containerID != "" {
+	for c, ip := range handler.ipOf {
+		if ip == containerIP {
+			containerID = c
 			break
 		}
 	}
+	handler.mtx.Unlock()
 
+	if containerID == "" {
+		return fmt.Errorf("no container with ip %s found", containerIP)
+	}
+
+	handler.stopping.Store(containerID, true)
 	err := handler.client.ContainerStop(context.Background(), containerID, client.ContainerStopOptions{})
 	if err != nil {
 		log.Printf("stopping container %s failed with err: %s, please remove manually", containerID, err)
@@ -400,6 +644,9 @@ func (handler *dockerHandler) Delete(containerIP string) error {
 		return err
 	}
 
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+
 	// remove Container from Containers
 
 	for i := 0; i < len(handler.containers); i++ {
@@ -411,6 +658,7 @@ func (handler *dockerHandler) Delete(containerIP string) error {
 
 	// remove ContainerIP from ContainerIPs
 
+	delete(handler.ipOf, containerID)
 	for i := 0; i < len(handler.containerIPs); i++ {
 		if handler.containerIPs[i] == containerIP {
 			handler.containerIPs = append(handler.containerIPs[:i], handler.containerIPs[(i+1):]...)
@@ -421,23 +669,83 @@ func (handler *dockerHandler) Delete(containerIP string) error {
 	return nil
 }
 
+// Stop removes every container and network which still carries the id of this AubeFaaS instance.
+// The images are kept, the versions in the store are deployed from them again on the next start.
 func (d DockerBackend) Stop() error {
-	return fmt.Errorf("currently not implemented")
+	log.Printf("removing remaining containers and networks of %s", d.id)
+	filters := make(client.Filters).Add("label", "AubeFaaS-ID="+d.id)
+
+	var errs []error
+
+	containers, err := d.client.ContainerList(context.Background(), client.ContainerListOptions{All: true, Filters: filters})
+	if err != nil {
+		return err
+	}
+
+	// networks can't be removed while containers are connected to them
+	for _, c := range containers {
+		d.stopping.Store(c.ID, true)
+		err = d.client.ContainerRemove(context.Background(), c.ID, client.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.Printf("not able to remove container %s with err: %v, please remove manually", c.ID, err)
+			errs = append(errs, fmt.Errorf("removing container %s: %w", c.ID, err))
+		}
+	}
+
+	networks, err := d.client.NetworkList(context.Background(), client.NetworkListOptions{Filters: filters})
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	for _, nw := range networks {
+		err = d.client.NetworkRemove(context.Background(), nw.ID)
+		if err != nil {
+			log.Printf("not able to remove network %s with err: %v, please remove manually", nw.ID, err)
+			errs = append(errs, fmt.Errorf("removing network %s: %w", nw.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func (handler *dockerHandler) IPs() []string {
-	return handler.containerIPs
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+
+	return slices.Clone(handler.containerIPs)
 }
 
-// Destroy cleans up the complete function, so every container gets shut down
+func (handler *dockerHandler) State() controlplane.FunctionState {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+
+	return controlplane.FunctionState{
+		Name:           handler.name,
+		UniqueName:     handler.uniqueName,
+		Version:        handler.version,
+		Image:          handler.image,
+		Network:        handler.network,
+		Containers:     slices.Clone(handler.containers),
+		IPs:            slices.Clone(handler.containerIPs),
+		DeployedAt:     handler.deployedAt,
+		FunctionConfig: handler.config,
+	}
+}
+
+// Destroy cleans up the deployment, so every container gets shut down.
+// The image is kept, other deployments or a later rollback might still need it.
 func (handler *dockerHandler) Destroy() error {
+	handler.mtx.Lock()
+	containers := slices.Clone(handler.containers)
+	handler.mtx.Unlock()
 
 	wg := sync.WaitGroup{}
-	for _, c := range handler.containers {
+	for _, c := range containers {
 
 		wg.Add(1)
 		go func(c string) {
 			defer wg.Done()
+			handler.stopping.Store(c, true)
 			err := handler.client.ContainerStop(context.Background(), c, client.ContainerStopOptions{})
 			if err != nil {
 				log.Printf("not able to stop container %s with err: %v, please remove manually", c, err)
@@ -456,12 +764,6 @@ func (handler *dockerHandler) Destroy() error {
 	err := handler.client.NetworkRemove(context.Background(), handler.network)
 	if err != nil {
 		log.Printf("not able to remove network: %s with err: %v, please remove manually", handler.network, err)
-	}
-
-	// We need to remove the image
-	_, err = handler.client.ImageRemove(context.Background(), handler.uniqueName, client.ImageRemoveOptions{})
-	if err != nil {
-		log.Printf("not able to remove the image")
 		return err
 	}
 
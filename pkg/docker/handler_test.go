@@ -0,0 +1,356 @@
+package docker
+
+import (
+	"aube/pkg/controlplane"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// fakeContainer is a container of the fake Docker host
+type fakeContainer struct {
+	id      string
+	name    string
+	image   string
+	labels  map[string]string
+	env     []string
+	network string
+	ip      string
+	state   string
+	created int64
+}
+
+// fakeDocker is an in-memory Docker host which serves the parts of the Engine API the backend uses
+type fakeDocker struct {
+	mtx        sync.Mutex
+	containers map[string]*fakeContainer
+	// network name -> labels
+	networks map[string]map[string]string
+	// image name -> labels
+	images map[string]map[string]string
+	// ips handed to started containers in order
+	ips []string
+}
+
+var apiPath = regexp.MustCompile(`^/v[0-9.]+(/.*)$`)
+
+// newFakeBackend returns a backend of the instance id which talks to a fake Docker host,
+// started containers get the given ips in order
+func newFakeBackend(t *testing.T, id string, ips ...string) (*DockerBackend, *fakeDocker) {
+	t.Helper()
+
+	fake := &fakeDocker{
+		containers: make(map[string]*fakeContainer),
+		networks:   make(map[string]map[string]string),
+		images:     make(map[string]map[string]string),
+		ips:        ips,
+	}
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &DockerBackend{id: "AubeFaaS-" + id, client: c, stopping: &sync.Map{}}, fake
+}
+
+// healthy serves /health on the health port of every ip, the test is skipped if the addresses are not available
+func healthy(t *testing.T, ips ...string) {
+	t.Helper()
+
+	for _, ip := range ips {
+		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, HealthPort))
+		if err != nil {
+			t.Skipf("not able to serve health checks on %s: %v", ip, err)
+		}
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		srv.Listener = l
+		srv.Start()
+		t.Cleanup(srv.Close)
+	}
+}
+
+// matches reports whether the labels match the label filters of a list request
+func matches(labels map[string]string, filters map[string]map[string]bool) bool {
+	for f := range filters["label"] {
+		k, v, ok := strings.Cut(f, "=")
+		if l, found := labels[k]; !found || (ok && l != v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fake *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+
+	path := req.URL.Path
+	if m := apiPath.FindStringSubmatch(path); m != nil {
+		path = m[1]
+	}
+
+	filters := make(map[string]map[string]bool)
+	if f := req.URL.Query().Get("filters"); f != "" {
+		json.Unmarshal([]byte(f), &filters)
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case req.Method == http.MethodPost && path == "/containers/create":
+		d := struct {
+			Image      string
+			Labels     map[string]string
+			Env        []string
+			HostConfig struct {
+				NetworkMode string
+			}
+		}{}
+		json.NewDecoder(req.Body).Decode(&d)
+
+		name := req.URL.Query().Get("name")
+		fake.containers[name] = &fakeContainer{
+			id:      name,
+			name:    name,
+			image:   d.Image,
+			labels:  d.Labels,
+			env:     d.Env,
+			network: d.HostConfig.NetworkMode,
+			state:   "created",
+			created: time.Now().Unix(),
+		}
+		writeFake(w, map[string]any{"Id": name, "Warnings": []string{}})
+
+	case req.Method == http.MethodGet && path == "/containers/json":
+		list := make([]map[string]any, 0)
+		for _, c := range fake.containers {
+			if !matches(c.labels, filters) {
+				continue
+			}
+			list = append(list, map[string]any{
+				"Id": c.id, "Names": []string{"/" + c.name}, "Image": c.image,
+				"Labels": c.labels, "State": c.state, "Created": c.created,
+			})
+		}
+		writeFake(w, list)
+
+	case len(parts) >= 2 && parts[0] == "containers":
+		c, ok := fake.containers[parts[1]]
+		if !ok {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case req.Method == http.MethodPost && len(parts) == 3 && parts[2] == "start":
+			c.state = "running"
+			if c.ip == "" && len(fake.ips) > 0 {
+				c.ip, fake.ips = fake.ips[0], fake.ips[1:]
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodPost && len(parts) == 3 && parts[2] == "stop":
+			c.state = "exited"
+			w.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodGet && len(parts) == 3 && parts[2] == "json":
+			networks := map[string]any{}
+			if c.network != "" {
+				networks[c.network] = map[string]any{"IPAddress": c.ip}
+			}
+			writeFake(w, map[string]any{
+				"Id": c.id, "Name": "/" + c.name, "State": map[string]any{"Status": c.state},
+				"NetworkSettings": map[string]any{"Networks": networks},
+			})
+		case req.Method == http.MethodDelete && len(parts) == 2:
+			delete(fake.containers, c.id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+
+	case req.Method == http.MethodPost && path == "/networks/create":
+		d := struct {
+			Name   string
+			Labels map[string]string
+		}{}
+		json.NewDecoder(req.Body).Decode(&d)
+
+		fake.networks[d.Name] = d.Labels
+		writeFake(w, map[string]any{"Id": d.Name})
+
+	case req.Method == http.MethodGet && path == "/networks":
+		list := make([]map[string]any, 0)
+		for name, labels := range fake.networks {
+			if !matches(labels, filters) {
+				continue
+			}
+			if n, ok := filters["name"]; ok && !slices.ContainsFunc(slices.Collect(maps.Keys(n)), func(f string) bool { return strings.Contains(name, f) }) {
+				continue
+			}
+			list = append(list, map[string]any{"Id": name, "Name": name, "Labels": labels})
+		}
+		writeFake(w, list)
+
+	case req.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "networks":
+		delete(fake.networks, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodGet && path == "/images/json":
+		list := make([]map[string]any, 0)
+		for name, labels := range fake.images {
+			if !matches(labels, filters) {
+				continue
+			}
+			if r, ok := filters["reference"]; ok && !r[name] {
+				continue
+			}
+			list = append(list, map[string]any{"Id": name, "RepoTags": []string{name + ":latest"}, "Labels": labels})
+		}
+		writeFake(w, list)
+
+	case req.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "images":
+		delete(fake.images, parts[1])
+		writeFake(w, []any{})
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeFake(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// deploy creates and starts a deployment of the function with the config on the fake Docker host
+func deploy(t *testing.T, d *DockerBackend, name string, config controlplane.FunctionConfig) *dockerHandler {
+	t.Helper()
+
+	h, err := d.Deploy(name, controlplane.Version{Number: 1, Image: name + "-image", Config: config}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := h.(*dockerHandler)
+	err = handler.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// Replace must be able to double a deployment which already runs maxThreads containers
+func TestReplaceAtMaxThreads(t *testing.T) {
+	ips := []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"}
+	healthy(t, ips...)
+	d, _ := newFakeBackend(t, "test", ips...)
+
+	config := controlplane.DefaultConfig()
+	config.InitThreads = 2
+	config.MaxThreads = 2
+	handler := deploy(t, d, "echo", config)
+
+	replaced, err := handler.Replace()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !slices.Equal(replaced, ips[2:]) {
+		t.Fatalf("expected the replacements %v, got %v", ips[2:], replaced)
+	}
+
+	if state := handler.State(); len(state.Containers) != 4 || state.MaxThreads != 2 {
+		t.Fatalf("expected 4 containers and an unchanged maxThreads, got %+v", state)
+	}
+
+	// the replaced containers are removed, afterward maxThreads applies again
+	for _, ip := range ips[:2] {
+		err = handler.Delete(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = handler.Add()
+	if err != controlplane.ErrMaxThreads {
+		t.Fatalf("expected %v, got %v", controlplane.ErrMaxThreads, err)
+	}
+}
+
+func TestSetSecrets(t *testing.T) {
+	d, fake := newFakeBackend(t, "test")
+
+	config := controlplane.DefaultConfig()
+	config.InitThreads = 0
+	config.Env = map[string]string{"MODE": "dev", "TOKEN": "env"}
+	h, err := d.Deploy("echo", controlplane.Version{Number: 1, Image: "echo-image", Config: config}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.SetSecrets(map[string]string{"TOKEN": "secret"})
+	id, err := h.Add()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mtx.Lock()
+	env := fake.containers[id].env
+	fake.mtx.Unlock()
+
+	for _, v := range []string{"MODE=dev", "TOKEN=secret"} {
+		if !slices.Contains(env, v) {
+			t.Fatalf("expected %s in the env of a new container, got %v", v, env)
+		}
+	}
+
+	if slices.Contains(env, "TOKEN=env") {
+		t.Fatalf("expected the secret to take precedence, got %v", env)
+	}
+}
+
+// A container is only part of the ips of a deployment once it is healthy, one which never gets healthy is removed
+func TestStartContainerUnhealthy(t *testing.T) {
+	d, fake := newFakeBackend(t, "test", "127.0.0.9")
+
+	config := controlplane.DefaultConfig()
+	config.InitThreads = 0
+	h, err := d.Deploy("echo", controlplane.Version{Number: 1, Image: "echo-image", Config: config}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := h.Add()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.StartContainer(id)
+	if err == nil {
+		t.Fatal("expected an unhealthy container to fail")
+	}
+
+	if state := h.State(); len(state.Containers) != 0 || len(state.IPs) != 0 {
+		t.Fatalf("expected the container to be removed, got %+v", state)
+	}
+
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+	if _, ok := fake.containers[id]; ok {
+		t.Fatal("expected the container to be removed from the Docker host")
+	}
+}
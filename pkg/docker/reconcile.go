@@ -0,0 +1,310 @@
+package docker
+
+import (
+	"aube/pkg/controlplane"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+)
+
+// Reconcile looks for containers, networks and images of this AubeFaaS instance which the control plane does not
+// know anymore, e.g. because it crashed during a deployment or its state file was restored from a backup. known are
+// the names of the functions and the uniqueNames and images of the deployments and versions the control plane knows,
+// they are never touched. With controlplane.ReconcileAdopt the newest deployment of every unknown function which
+// still has running containers is taken over, with controlplane.ReconcileRemove the orphans are removed and with
+// controlplane.ReconcileNone they are only logged. Resources of earlier instances, e.g. whose state file was lost,
+// are reconciled as well if their id was passed to New, the resources of other instances on the same Docker host are ignored.
+func (d DockerBackend) Reconcile(policy controlplane.ReconcilePolicy, known map[string]bool) (map[string]controlplane.Handler, error) {
+	adopted := make(map[string]controlplane.Handler)
+
+	switch policy {
+	case controlplane.ReconcileNone, controlplane.ReconcileRemove, controlplane.ReconcileAdopt:
+	default:
+		return nil, fmt.Errorf("unknown reconcile policy: %s", policy)
+	}
+
+	// every AubeFaaS resource, the ones of other instances are skipped below as they might share the Docker host
+	filters := make(client.Filters).Add("label", "AubeFaaS-ID")
+
+	containers, err := d.client.ContainerList(context.Background(), client.ContainerListOptions{All: true, Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+
+	// uniqueName -> orphaned containers
+	functions := make(map[string][]container.Summary)
+	for _, c := range containers {
+		uniqueName := c.Labels["AubeFaaS-Function"]
+		if known[uniqueName] || !d.reconciles(c.Labels) {
+			continue
+		}
+		functions[uniqueName] = append(functions[uniqueName], c)
+	}
+
+	// uniqueNames and images of the deployments which have been adopted, their resources are kept
+	kept := make(map[string]bool)
+
+	if policy == controlplane.ReconcileAdopt {
+		uniqueNames := make([]string, 0, len(functions))
+		for uniqueName := range functions {
+			uniqueNames = append(uniqueNames, uniqueName)
+		}
+
+		// the newest deployment of a function wins, older ones are removed
+		slices.SortFunc(uniqueNames, func(a, b string) int {
+			return int(newest(functions[b]) - newest(functions[a]))
+		})
+
+		for _, uniqueName := range uniqueNames {
+			name := functionName(uniqueName)
+			if _, ok := adopted[name]; ok || known[name] {
+				// a known function keeps the versions of the store
+				continue
+			}
+
+			handler, err := d.adopt(name, uniqueName, functions[uniqueName])
+			if err != nil {
+				log.Printf("not able to adopt function %s, removing it: %v", uniqueName, err)
+				continue
+			}
+
+			adopted[name] = handler
+			kept[uniqueName] = true
+			kept[handler.image] = true
+		}
+	}
+
+	var errs []error
+
+	for uniqueName, cs := range functions {
+		for _, c := range cs {
+			// adopted functions only keep their running containers
+			if kept[uniqueName] && c.State == container.StateRunning {
+				continue
+			}
+
+			if policy == controlplane.ReconcileNone {
+				log.Printf("found orphaned container %s of %s, leaving it untouched", c.ID, uniqueName)
+				continue
+			}
+
+			log.Printf("removing orphaned container %s of %s", c.ID, uniqueName)
+			d.stopping.Store(c.ID, true)
+			err = d.client.ContainerRemove(context.Background(), c.ID, client.ContainerRemoveOptions{Force: true})
+			if err != nil {
+				log.Printf("not able to remove container %s with err: %v, please remove manually", c.ID, err)
+				errs = append(errs, fmt.Errorf("removing container %s: %w", c.ID, err))
+			}
+		}
+	}
+
+	networks, err := d.client.NetworkList(context.Background(), client.NetworkListOptions{Filters: filters})
+	if err != nil {
+		return adopted, errors.Join(append(errs, err)...)
+	}
+
+	for _, nw := range networks {
+		if known[nw.Name] || kept[nw.Name] || !d.reconciles(nw.Labels) {
+			continue
+		}
+
+		if policy == controlplane.ReconcileNone {
+			log.Printf("found orphaned network %s, leaving it untouched", nw.Name)
+			continue
+		}
+
+		log.Printf("removing orphaned network %s", nw.Name)
+		err = d.client.NetworkRemove(context.Background(), nw.ID)
+		if err != nil {
+			log.Printf("not able to remove network %s with err: %v, please remove manually", nw.ID, err)
+			errs = append(errs, fmt.Errorf("removing network %s: %w", nw.ID, err))
+		}
+	}
+
+	images, err := d.client.ImageList(context.Background(), client.ImageListOptions{Filters: filters})
+	if err != nil {
+		return adopted, errors.Join(append(errs, err)...)
+	}
+
+	for _, img := range images {
+		image := img.Labels["AubeFaaS-Function"]
+		if known[image] || kept[image] || !d.reconciles(img.Labels) {
+			continue
+		}
+
+		if policy == controlplane.ReconcileNone {
+			log.Printf("found orphaned image %s, leaving it untouched", image)
+			continue
+		}
+
+		log.Printf("removing orphaned image %s", image)
+		_, err = d.client.ImageRemove(context.Background(), img.ID, client.ImageRemoveOptions{Force: true})
+		if err != nil {
+			log.Printf("not able to remove image %s with err: %v, please remove manually", img.ID, err)
+			errs = append(errs, fmt.Errorf("removing image %s: %w", img.ID, err))
+		}
+	}
+
+	return adopted, errors.Join(errs...)
+}
+
+// reconciles reports whether the resource with the labels belongs to this instance or one of its earlier ids
+func (d DockerBackend) reconciles(labels map[string]string) bool {
+	id := labels["AubeFaaS-ID"]
+	return id == d.id || slices.Contains(d.earlierIDs, "*") || slices.Contains(d.earlierIDs, id)
+}
+
+// Restore rebuilds the handler of a function of this AubeFaaS instance from its persisted state.
+// The running containers are looked up again, as their ips might have changed in the meantime.
+func (d DockerBackend) Restore(state controlplane.FunctionState, secrets map[string]string) (controlplane.Handler, error) {
+	containers, err := d.client.ContainerList(context.Background(), client.ContainerListOptions{
+		All:     true,
+		Filters: make(client.Filters).Add("label", "AubeFaaS-Function="+state.UniqueName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := d.adopt(state.Name, state.UniqueName, containers)
+	if err != nil {
+		return nil, err
+	}
+
+	handler.config = state.FunctionConfig
+	handler.image = state.Image
+	handler.version = state.Version
+	handler.secrets = secrets
+	handler.config.MaxThreads = max(state.MaxThreads, len(handler.containers))
+	handler.deployedAt = state.DeployedAt
+	// new containers are created from the restored config
+	d.configure(handler)
+
+	// containers which are not running anymore would only block their name
+	for _, c := range containers {
+		if c.State == container.StateRunning {
+			continue
+		}
+
+		log.Printf("removing container %s of %s which is %s", c.ID, state.UniqueName, c.State)
+		err = d.client.ContainerRemove(context.Background(), c.ID, client.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.Printf("not able to remove container %s with err: %v, please remove manually", c.ID, err)
+		}
+	}
+
+	return handler, nil
+}
+
+// adopt rebuilds a dockerHandler from the running containers of a deployment of an earlier run
+func (d DockerBackend) adopt(name string, uniqueName string, containers []container.Summary) (*dockerHandler, error) {
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("no containers")
+	}
+
+	nws, err := d.client.NetworkList(context.Background(), client.NetworkListOptions{
+		Filters: make(client.Filters).Add("name", uniqueName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the name filter matches substrings as well
+	idx := slices.IndexFunc(nws, func(nw network.Summary) bool { return nw.Name == uniqueName })
+	if idx < 0 {
+		return nil, fmt.Errorf("network %s not found", uniqueName)
+	}
+
+	// every container of a deployment runs the image of its version
+	image := containers[0].Image
+	images, err := d.client.ImageList(context.Background(), client.ImageListOptions{
+		Filters: make(client.Filters).Add("reference", image),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("image %s not found", image)
+	}
+
+	// versions of earlier runs are unknown, an adopted deployment becomes the first version
+	handler := &dockerHandler{
+		name:         name,
+		uniqueName:   uniqueName,
+		image:        image,
+		version:      1,
+		client:       d.client,
+		stopping:     d.stopping,
+		config:       controlplane.DefaultConfig(),
+		deployedAt:   time.Unix(newest(containers), 0),
+		network:      nws[idx].ID,
+		containers:   make([]string, 0, len(containers)),
+		containerIPs: make([]string, 0, len(containers)),
+		ipOf:         make(map[string]string),
+	}
+
+	for _, c := range containers {
+		// container names are <uniqueName>-<idx>, new containers must not reuse an index
+		if len(c.Names) > 0 {
+			i, err := strconv.Atoi(strings.TrimPrefix(c.Names[0], "/"+uniqueName+"-"))
+			if err == nil {
+				handler.nextContainer = max(handler.nextContainer, i+1)
+			}
+		}
+
+		if c.State != container.StateRunning {
+			log.Printf("not adopting container %s of %s which is %s", c.ID, uniqueName, c.State)
+			continue
+		}
+
+		insp, err := d.client.ContainerInspect(context.Background(), c.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		nw, ok := insp.NetworkSettings.Networks[uniqueName]
+		if !ok {
+			return nil, fmt.Errorf("container %s is not connected to network %s", c.ID, uniqueName)
+		}
+
+		handler.containers = append(handler.containers, c.ID)
+		handler.containerIPs = append(handler.containerIPs, nw.IPAddress.String())
+		handler.ipOf[c.ID] = nw.IPAddress.String()
+	}
+
+	if len(handler.containers) == 0 {
+		return nil, fmt.Errorf("no running containers")
+	}
+
+	handler.config.MaxThreads = max(handler.config.MaxThreads, len(handler.containers))
+
+	d.configure(handler)
+
+	return handler, nil
+}
+
+// newest returns the creation time of the most recently created container
+func newest(containers []container.Summary) int64 {
+	var created int64
+	for _, c := range containers {
+		created = max(created, c.Created)
+	}
+	return created
+}
+
+// functionName strips the uuid suffix of the uniqueName of a function
+func functionName(uniqueName string) string {
+	// <name>-<uuid>, a uuid has 36 characters
+	if len(uniqueName) <= 37 {
+		return uniqueName
+	}
+	return uniqueName[:len(uniqueName)-37]
+}
@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"aube/pkg/controlplane"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// orphan adds a deployment with a single container, its network and its image to the fake Docker host
+func orphan(fake *fakeDocker, id string, uniqueName string, state string, ip string) {
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+
+	image := uniqueName + "-image"
+	labels := map[string]string{"AubeFaaS-ID": "AubeFaaS-" + id, "AubeFaaS-Function": uniqueName}
+	fake.containers[uniqueName+"-0"] = &fakeContainer{
+		id:      uniqueName + "-0",
+		name:    uniqueName + "-0",
+		image:   image,
+		labels:  labels,
+		network: uniqueName,
+		ip:      ip,
+		state:   state,
+		created: 1,
+	}
+	fake.networks[uniqueName] = labels
+	fake.images[image] = map[string]string{"AubeFaaS-ID": "AubeFaaS-" + id, "AubeFaaS-Function": image}
+}
+
+// left returns the names of the containers, networks and images on the fake Docker host
+func left(fake *fakeDocker) ([]string, []string, []string) {
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+
+	return slices.Sorted(maps.Keys(fake.containers)), slices.Sorted(maps.Keys(fake.networks)), slices.Sorted(maps.Keys(fake.images))
+}
+
+// Orphans of this instance and of the earlier ids are removed, known resources and the ones of other instances are kept
+func TestReconcileRemoveEarlierIDs(t *testing.T) {
+	d, fake := newFakeBackend(t, "test")
+	d.earlierIDs = []string{"AubeFaaS-old"}
+
+	orphan(fake, "test", "current", "exited", "")
+	orphan(fake, "old", "earlier", "running", "10.0.0.2")
+	orphan(fake, "other", "foreign", "running", "10.0.0.3")
+	orphan(fake, "test", "known", "running", "10.0.0.4")
+
+	known := map[string]bool{"known": true, "known-image": true}
+	adopted, err := d.Reconcile(controlplane.ReconcileRemove, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adopted) != 0 {
+		t.Fatalf("expected nothing to be adopted, got %v", adopted)
+	}
+
+	containers, networks, images := left(fake)
+	if !slices.Equal(containers, []string{"foreign-0", "known-0"}) {
+		t.Fatalf("unexpected containers left: %v", containers)
+	}
+	if !slices.Equal(networks, []string{"foreign", "known"}) {
+		t.Fatalf("unexpected networks left: %v", networks)
+	}
+	if !slices.Equal(images, []string{"foreign-image", "known-image"}) {
+		t.Fatalf("unexpected images left: %v", images)
+	}
+}
+
+// Without earlier ids only the resources of this instance are reconciled
+func TestReconcileNoEarlierIDs(t *testing.T) {
+	d, fake := newFakeBackend(t, "test")
+
+	orphan(fake, "test", "current", "exited", "")
+	orphan(fake, "old", "earlier", "running", "10.0.0.2")
+
+	_, err := d.Reconcile(controlplane.ReconcileRemove, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers, networks, images := left(fake)
+	if !slices.Equal(containers, []string{"earlier-0"}) || !slices.Equal(networks, []string{"earlier"}) || !slices.Equal(images, []string{"earlier-image"}) {
+		t.Fatalf("expected only the resources of the earlier id to be left, got %v, %v, %v", containers, networks, images)
+	}
+}
+
+// A running deployment of an earlier id is adopted with "*"
+func TestReconcileAdoptEarlierID(t *testing.T) {
+	d, fake := newFakeBackend(t, "test")
+	d.earlierIDs = []string{"*"}
+
+	uniqueName := "echo-0b5e7f3a-8a8e-4c61-9a2f-2d1f4c5e6a7b"
+	orphan(fake, "old", uniqueName, "running", "10.0.0.2")
+
+	adopted, err := d.Reconcile(controlplane.ReconcileAdopt, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, ok := adopted["echo"]
+	if !ok {
+		t.Fatalf("expected function echo to be adopted, got %v", adopted)
+	}
+	if ips := handler.IPs(); !slices.Equal(ips, []string{"10.0.0.2"}) {
+		t.Fatalf("expected the ip of the running container, got %v", ips)
+	}
+
+	containers, networks, images := left(fake)
+	if len(containers) != 1 || len(networks) != 1 || len(images) != 1 {
+		t.Fatalf("expected the adopted resources to be kept, got %v, %v, %v", containers, networks, images)
+	}
+}
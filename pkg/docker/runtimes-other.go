@@ -0,0 +1,12 @@
+//go:build !arm64
+// +build !arm64
+
+package docker
+
+import "embed"
+
+// runtimes are only built for the supported architectures (see SUPPORTED_ARCH in the Makefile),
+// on other ones every runtime is reported as not supported
+var runtimes embed.FS
+
+const runtimesDir = "runtimes-other"
@@ -1,4 +1,6 @@
 import http.server
+import importlib
+import os
 import threading
 
 from websockets.sync.server import serve
@@ -20,10 +22,13 @@ def start_health_server(host: str = "0.0.0.0", port: int = 8080):
     s.serve_forever()
 
 if __name__ == "__main__":
+    # <module>:<function>, set by the control plane from the function config
+    module_name, function_name = os.environ.get("AUBE_ENTRYPOINT", "fn:fn").split(":", 1)
+
     try:
-        from fn import fn
-    except ImportError:
-        raise ImportError("Failed to import fn.py")
+        fn = getattr(importlib.import_module(module_name), function_name)
+    except (ImportError, AttributeError):
+        raise ImportError(f"Failed to import {function_name} from {module_name}.py")
 
 
     def function_handler(websocket) -> None:
@@ -0,0 +1,207 @@
+package rproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// SessionHeader carries the session token, it is issued in the upgrade response and sent by a reconnecting
+	// client. The containers get it as well, so a function can tell its sessions apart.
+	SessionHeader = "X-Aube-Session"
+	// SessionParam is the query parameter alternative to SessionHeader, e.g. for browsers
+	SessionParam = "session"
+)
+
+// affinity binds a session token to the container of the session. Once the session ends, the container is
+// reserved for the token for ResumeGrace instead of going back to the free containers.
+type affinity struct {
+	ip string
+	// client connection of the session running on the container, nil while the container is reserved
+	conn *websocket.Conn
+	// closed once the running session ended
+	done chan struct{}
+	// expiry hands the reserved container out again after the grace window
+	expiry *time.Timer
+}
+
+// sessionToken returns the session token a client sent, it is empty for new clients
+func sessionToken(req *http.Request) string {
+	if token := req.Header.Get(SessionHeader); token != "" {
+		return token
+	}
+
+	return req.URL.Query().Get(SessionParam)
+}
+
+// newSessionToken returns a random token which can't be guessed by other clients. The token is
+// <nonce>.<mac>, the mac binds it to the principal, so only the same principal can resume the session.
+func (r *RProxy) newSessionToken(principal Principal) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	return nonce + "." + r.sessionMAC(nonce, principal)
+}
+
+// validSessionToken reports whether the token was issued by this proxy to the principal
+func (r *RProxy) validSessionToken(token string, principal Principal) bool {
+	nonce, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+
+	return hmac.Equal([]byte(mac), []byte(r.sessionMAC(nonce, principal)))
+}
+
+// sessionMAC is the HMAC of the nonce of a session token and the principal
+func (r *RProxy) sessionMAC(nonce string, principal Principal) string {
+	h := hmac.New(sha256.New, r.tokenKey)
+	h.Write([]byte(principal.Method + "\x00" + principal.Subject + "\x00" + nonce))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hasAffinity reports whether the token is bound to a container of the function
+func (f *Function) hasAffinity(token string) bool {
+	f.hl.RLock()
+	defer f.hl.RUnlock()
+
+	_, ok := f.affinities[token]
+	return ok
+}
+
+// resume blocks the container bound to the token for a reconnecting client. A session which still runs
+// on it, e.g. because the server side did not notice the dropped connection yet, is closed and the
+// container is taken over once it ended. ok is false if the container is gone or ctx is done first.
+func (f *Function) resume(ctx context.Context, token string) (string, bool) {
+	for {
+		f.hl.Lock()
+		a, ok := f.affinities[token]
+		if !ok {
+			f.hl.Unlock()
+			return "", false
+		}
+
+		if f.reserved[a.ip] == token {
+			// the session binds the token again once it reached the container
+			a.expiry.Stop()
+			delete(f.reserved, a.ip)
+			delete(f.affinities, token)
+			f.usedIPs = append(f.usedIPs, a.ip)
+			f.hl.Unlock()
+
+			log.Printf("session %s of function %s resumed on container %s", token, f.name, a.ip)
+			return a.ip, true
+		}
+
+		if a.conn == nil {
+			// the session on it ended, but the container was dropped
+			delete(f.affinities, token)
+			f.hl.Unlock()
+			return "", false
+		}
+
+		log.Printf("session %s of function %s reconnected while its previous connection is open, closing it", token, f.name)
+		a.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session resumed by another connection"),
+			time.Now().Add(time.Second),
+		)
+		a.conn.Close()
+		done := a.done
+		f.hl.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return "", false
+		}
+	}
+}
+
+// bind binds the token to the container of the session which runs on conn
+func (f *Function) bind(token string, containerIP string, conn *websocket.Conn) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	f.affinities[token] = &affinity{
+		ip:   containerIP,
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+// reserve ends the session on conn and holds its container for the token until the grace window is over.
+// Containers which were removed in the meantime are dropped like in freeContainer.
+func (f *Function) reserve(token string, containerIP string, conn *websocket.Conn) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	a, ok := f.affinities[token]
+	if !ok || a.conn != conn || !slices.Contains(f.usedIPs, containerIP) {
+		err := f.free(containerIP)
+		if err != nil {
+			log.Printf("not able to free container %s of function %s: %v", containerIP, f.name, err)
+		}
+		return
+	}
+
+	f.usedIPs = remove(f.usedIPs, containerIP)
+	a.conn = nil
+	close(a.done)
+
+	if f.draining[containerIP] {
+		log.Printf("session on removed container %s of function %s ended, dropping it", containerIP, f.name)
+		delete(f.draining, containerIP)
+		delete(f.lastUsed, containerIP)
+		delete(f.affinities, token)
+		return
+	}
+
+	grace := f.settings.ResumeGrace
+	f.reserved[containerIP] = token
+	f.lastUsed[containerIP] = time.Now()
+	a.expiry = time.AfterFunc(grace, func() {
+		f.expire(token, containerIP)
+	})
+
+	log.Printf("reserved container %s of function %s for session %s for %v", containerIP, f.name, token, grace)
+}
+
+// expire hands a reserved container out again, unless it was resumed or removed in the meantime
+func (f *Function) expire(token string, containerIP string) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	if f.reserved[containerIP] != token {
+		return
+	}
+
+	log.Printf("session %s of function %s did not resume, freeing container %s", token, f.name, containerIP)
+	delete(f.reserved, containerIP)
+	delete(f.affinities, token)
+	f.addContainers([]string{containerIP})
+}
+
+// unreserve drops the reservation of a removed container, f.hl must be held
+func (f *Function) unreserve(containerIP string) {
+	token, ok := f.reserved[containerIP]
+	if !ok {
+		return
+	}
+
+	if a, ok := f.affinities[token]; ok {
+		a.expiry.Stop()
+		delete(f.affinities, token)
+	}
+	delete(f.reserved, containerIP)
+}
@@ -0,0 +1,34 @@
+package rproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+// A session token can only be resumed by the principal it was issued to and only on the proxy which issued it
+func TestSessionTokenPrincipal(t *testing.T) {
+	proxy := New(Settings{})
+	alice := Principal{Subject: "alice", Method: AuthAPIKey}
+	token := proxy.newSessionToken(alice)
+
+	if !proxy.validSessionToken(token, alice) {
+		t.Fatalf("expected the token to be valid for its principal")
+	}
+	if proxy.validSessionToken(token, Principal{Subject: "bob", Method: AuthAPIKey}) {
+		t.Fatalf("expected the token to be invalid for another subject")
+	}
+	if proxy.validSessionToken(token, Principal{Subject: "alice", Method: AuthJWT}) {
+		t.Fatalf("expected the token to be invalid for another method")
+	}
+
+	nonce, mac, _ := strings.Cut(token, ".")
+	if proxy.validSessionToken(nonce, alice) || proxy.validSessionToken("0"+nonce+"."+mac, alice) {
+		t.Fatalf("expected tampered tokens to be invalid")
+	}
+	if New(Settings{}).validSessionToken(token, alice) {
+		t.Fatalf("expected the token to be invalid on another proxy")
+	}
+	if other := proxy.newSessionToken(alice); other == token {
+		t.Fatalf("expected a new token for every session")
+	}
+}
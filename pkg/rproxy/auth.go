@@ -0,0 +1,287 @@
+package rproxy
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// PrincipalHeader and AuthMethodHeader forward the authenticated principal of a session to the container
+	PrincipalHeader  = "X-Aube-Principal"
+	AuthMethodHeader = "X-Aube-Auth-Method"
+	// TokenParam is the query parameter alternative to the Authorization header, browsers can't set headers on WebSockets
+	TokenParam = "access_token"
+
+	AuthAPIKey = "apikey"
+	AuthJWT    = "jwt"
+)
+
+var (
+	// ErrUnauthorized is returned if a session has no or invalid credentials
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned if the principal of a session may not use the function
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalidAuthConfig is returned if the auth config can't be used
+	ErrInvalidAuthConfig = errors.New("invalid auth config")
+)
+
+// Principal is the authenticated client of a session, the zero value is an anonymous client
+type Principal struct {
+	Subject string `json:"subject"`
+	// Method is AuthAPIKey or AuthJWT
+	Method string `json:"method"`
+}
+
+// Authenticator authenticates the sessions of the user endpoint
+type Authenticator interface {
+	// Authenticate returns the principal of a session on the function, the function is the first segment
+	// of a route or the function a backend was registered for. It returns ErrUnauthorized for missing or
+	// invalid credentials and ErrForbidden if the principal may not use the function.
+	Authenticate(function string, req *http.Request) (Principal, error)
+}
+
+// AuthConfig configures the built-in Authenticator
+type AuthConfig struct {
+	// APIKeys are the static keys of a function by their name, the name is the subject of the principal.
+	// A function with keys only accepts sessions with one of them or a valid JWT.
+	APIKeys map[string]map[string]string `json:"apiKeys"`
+	// JWTSecret verifies HS256 and JWTPublicKey (PEM) RS256 signed bearer tokens. The subject of a token
+	// is its "sub" claim, a token with an "aud" claim is only valid for the functions listed in it.
+	// On a function with API keys a token needs an "aud" claim listing it.
+	JWTSecret    string `json:"jwtSecret"`
+	JWTPublicKey string `json:"jwtPublicKey"`
+	// JWTIssuer is the required "iss" claim, if set
+	JWTIssuer string `json:"jwtIssuer"`
+	// JWTAudienceRequired rejects tokens without an "aud" claim on every function
+	JWTAudienceRequired bool `json:"jwtAudienceRequired"`
+	// Required rejects sessions without credentials on functions without API keys as well
+	Required bool `json:"required"`
+}
+
+// Auth is the built-in Authenticator with static API keys and JWT bearer tokens
+type Auth struct {
+	config    AuthConfig
+	publicKey *rsa.PublicKey
+}
+
+func NewAuth(config AuthConfig) (*Auth, error) {
+	a := &Auth{config: config}
+
+	if config.JWTPublicKey != "" {
+		block, _ := pem.Decode([]byte(config.JWTPublicKey))
+		if block == nil {
+			return nil, fmt.Errorf("%w: jwtPublicKey is not PEM encoded", ErrInvalidAuthConfig)
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: jwtPublicKey: %v", ErrInvalidAuthConfig, err)
+		}
+
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: jwtPublicKey must be an RSA key", ErrInvalidAuthConfig)
+		}
+		a.publicKey = rsaKey
+	}
+
+	for function, keys := range config.APIKeys {
+		for name, key := range keys {
+			if name == "" || key == "" {
+				return nil, fmt.Errorf("%w: API key of function %s without a name or value", ErrInvalidAuthConfig, function)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// Authenticate checks the bearer token of the Authorization header or the access_token query parameter
+func (a *Auth) Authenticate(function string, req *http.Request) (Principal, error) {
+	token := bearerToken(req)
+	keys := a.config.APIKeys[function]
+
+	if token == "" {
+		if a.config.Required || len(keys) > 0 {
+			return Principal{}, fmt.Errorf("%w: no credentials", ErrUnauthorized)
+		}
+		return Principal{}, nil
+	}
+
+	if strings.Count(token, ".") == 2 && (a.config.JWTSecret != "" || a.publicKey != nil) {
+		// a token for every function must not bypass the keys of a function
+		return a.verifyJWT(function, token, a.config.JWTAudienceRequired || len(keys) > 0)
+	}
+
+	for name, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return Principal{Subject: name, Method: AuthAPIKey}, nil
+		}
+	}
+
+	return Principal{}, fmt.Errorf("%w: unknown API key", ErrUnauthorized)
+}
+
+// jwtClaims are the registered claims of a token the proxy checks
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is the "aud" claim, which is either a string or a list of strings
+type audience []string
+
+func (aud *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*aud = audience{single}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*aud = list
+	return err
+}
+
+// verifyJWT checks the signature and the claims of a token for a session on the function,
+// with audienceRequired the token must list the function in its "aud" claim
+func (a *Auth) verifyJWT(function string, token string, audienceRequired bool) (Principal, error) {
+	parts := strings.Split(token, ".")
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: token header: %v", ErrUnauthorized, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: token signature: %v", ErrUnauthorized, err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	switch {
+	case header.Alg == "HS256" && a.config.JWTSecret != "":
+		mac := hmac.New(sha256.New, []byte(a.config.JWTSecret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return Principal{}, fmt.Errorf("%w: invalid token signature", ErrUnauthorized)
+		}
+	case header.Alg == "RS256" && a.publicKey != nil:
+		err = rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return Principal{}, fmt.Errorf("%w: invalid token signature", ErrUnauthorized)
+		}
+	default:
+		return Principal{}, fmt.Errorf("%w: token algorithm %q is not accepted", ErrUnauthorized, header.Alg)
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: token claims: %v", ErrUnauthorized, err)
+	}
+
+	now := float64(time.Now().Unix())
+	if claims.ExpiresAt != nil && now >= *claims.ExpiresAt {
+		return Principal{}, fmt.Errorf("%w: token expired", ErrUnauthorized)
+	}
+
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return Principal{}, fmt.Errorf("%w: token not valid yet", ErrUnauthorized)
+	}
+
+	if a.config.JWTIssuer != "" && claims.Issuer != a.config.JWTIssuer {
+		return Principal{}, fmt.Errorf("%w: token issued by %q", ErrUnauthorized, claims.Issuer)
+	}
+
+	if claims.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: token without a subject", ErrUnauthorized)
+	}
+
+	if len(claims.Audience) == 0 && audienceRequired {
+		return Principal{}, fmt.Errorf("%w: token of %s without an audience is not valid for function %s", ErrForbidden, claims.Subject, function)
+	}
+
+	if len(claims.Audience) > 0 && !slices.Contains(claims.Audience, function) {
+		return Principal{}, fmt.Errorf("%w: token of %s is not valid for function %s", ErrForbidden, claims.Subject, function)
+	}
+
+	return Principal{Subject: claims.Subject, Method: AuthJWT}, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// bearerToken returns the credentials of a session, it is empty if the client sent none
+func bearerToken(req *http.Request) string {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	return req.URL.Query().Get(TokenParam)
+}
+
+// SetAuthenticator authenticates every session of the user endpoint with a, nil accepts every session
+func (r *RProxy) SetAuthenticator(a Authenticator) {
+	r.hl.Lock()
+	defer r.hl.Unlock()
+
+	r.auth = a
+}
+
+// AllowOrigins restricts the browser origins which may open sessions, requests without an Origin header
+// (i.e. not from a browser) are not affected. "*" or no origins allow every origin.
+// It must be called before the proxy serves sessions.
+func (r *RProxy) AllowOrigins(origins []string) {
+	if len(origins) == 0 || slices.Contains(origins, "*") {
+		r.upgrader.CheckOrigin = func(req *http.Request) bool { return true }
+		return
+	}
+
+	r.upgrader.CheckOrigin = func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		return origin == "" || slices.Contains(origins, origin)
+	}
+}
+
+// authenticate authenticates a session on the function with the authenticator of the proxy
+func (r *RProxy) authenticate(function string, req *http.Request) (Principal, error) {
+	r.hl.RLock()
+	a := r.auth
+	r.hl.RUnlock()
+
+	if a == nil {
+		return Principal{}, nil
+	}
+
+	return a.Authenticate(function, req)
+}
@@ -0,0 +1,267 @@
+package rproxy
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+
+// segment encodes v as a base64url encoded JSON segment of a token
+func segment(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hs256 returns a token with the claims signed by secret
+func hs256(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+
+	signed := segment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// rs256 returns a token with the claims signed by key
+func rs256(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+
+	signed := segment(t, map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// tamper replaces the claims of a token, keeping its signature
+func tamper(t *testing.T, token string, claims map[string]any) string {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + segment(t, claims) + "." + parts[2]
+}
+
+// authenticate authenticates a session on the function with the bearer token
+func authenticate(t *testing.T, a *Auth, function string, token string) (Principal, error) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/"+function, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.Authenticate(function, req)
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	a, err := NewAuth(AuthConfig{JWTSecret: testSecret, JWTIssuer: "https://auth.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "https://auth.example.com"}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", hs256(t, testSecret, claims(nil)), nil},
+		{"bad signature", hs256(t, "other", claims(nil)), ErrUnauthorized},
+		{"tampered claims", tamper(t, hs256(t, testSecret, claims(nil)), claims(map[string]any{"sub": "mallory"})), ErrUnauthorized},
+		{"expired", hs256(t, testSecret, claims(map[string]any{"exp": now - 60})), ErrUnauthorized},
+		{"not expired", hs256(t, testSecret, claims(map[string]any{"exp": now + 60})), nil},
+		{"not valid yet", hs256(t, testSecret, claims(map[string]any{"nbf": now + 60})), ErrUnauthorized},
+		{"valid since", hs256(t, testSecret, claims(map[string]any{"nbf": now - 60})), nil},
+		{"other issuer", hs256(t, testSecret, claims(map[string]any{"iss": "https://evil.example.com"})), ErrUnauthorized},
+		{"no subject", hs256(t, testSecret, claims(map[string]any{"sub": ""})), ErrUnauthorized},
+		{"audience", hs256(t, testSecret, claims(map[string]any{"aud": "echo"})), nil},
+		{"audience list", hs256(t, testSecret, claims(map[string]any{"aud": []string{"chat", "echo"}})), nil},
+		{"other audience", hs256(t, testSecret, claims(map[string]any{"aud": "chat"})), ErrForbidden},
+		{"RS256 without a public key", rs256(t, mustKey(t), claims(nil)), ErrUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := authenticate(t, a, "echo", tt.token)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if p.Subject != "alice" || p.Method != AuthJWT {
+				t.Fatalf("unexpected principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRS256(t *testing.T) {
+	key := mustKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuth(AuthConfig{JWTPublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := authenticate(t, a, "echo", rs256(t, key, map[string]any{"sub": "alice"}))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if p.Subject != "alice" || p.Method != AuthJWT {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+
+	_, err = authenticate(t, a, "echo", rs256(t, mustKey(t), map[string]any{"sub": "alice"}))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v for a token of another key, got %v", ErrUnauthorized, err)
+	}
+
+	// without a secret, a HS256 token signed with the public key must not be accepted
+	_, err = authenticate(t, a, "echo", hs256(t, a.config.JWTPublicKey, map[string]any{"sub": "alice"}))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v for a HS256 token, got %v", ErrUnauthorized, err)
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	config := AuthConfig{APIKeys: map[string]map[string]string{"echo": {"ci": "key-1"}}}
+	a, err := NewAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := authenticate(t, a, "echo", "key-1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if p.Subject != "ci" || p.Method != AuthAPIKey {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+
+	_, err = authenticate(t, a, "echo", "key-2")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v for an unknown key, got %v", ErrUnauthorized, err)
+	}
+
+	_, err = authenticate(t, a, "echo", "")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v without credentials on a function with keys, got %v", ErrUnauthorized, err)
+	}
+
+	// the keys of a function are not valid for another one
+	_, err = authenticate(t, a, "chat", "key-1")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v for the key of another function, got %v", ErrUnauthorized, err)
+	}
+
+	p, err = authenticate(t, a, "chat", "")
+	if err != nil || p != (Principal{}) {
+		t.Fatalf("expected an anonymous session on a function without keys, got %+v, %v", p, err)
+	}
+
+	config.Required = true
+	a, err = NewAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = authenticate(t, a, "chat", "")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v without credentials if they are required, got %v", ErrUnauthorized, err)
+	}
+}
+
+// A token without an audience must not bypass the API keys of a function
+func TestAuthenticateJWTAudience(t *testing.T) {
+	config := AuthConfig{JWTSecret: testSecret, APIKeys: map[string]map[string]string{"echo": {"ci": "key-1"}}}
+	a, err := NewAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global := hs256(t, testSecret, map[string]any{"sub": "alice"})
+	_, err = authenticate(t, a, "echo", global)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v for a token without an audience on a function with keys, got %v", ErrForbidden, err)
+	}
+
+	_, err = authenticate(t, a, "echo", hs256(t, testSecret, map[string]any{"sub": "alice", "aud": "echo"}))
+	if err != nil {
+		t.Fatalf("expected a token for the function to be valid, got %v", err)
+	}
+
+	_, err = authenticate(t, a, "chat", global)
+	if err != nil {
+		t.Fatalf("expected a token without an audience to be valid on a function without keys, got %v", err)
+	}
+
+	config.JWTAudienceRequired = true
+	a, err = NewAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = authenticate(t, a, "chat", global)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v for a token without an audience if it is required, got %v", ErrForbidden, err)
+	}
+}
+
+func TestAuthenticateQueryToken(t *testing.T) {
+	a, err := NewAuth(AuthConfig{APIKeys: map[string]map[string]string{"echo": {"browser": "key-1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/echo?"+TokenParam+"=key-1", nil)
+	p, err := a.Authenticate("echo", req)
+	if err != nil || p.Subject != "browser" {
+		t.Fatalf("expected the principal of the query token, got %+v, %v", p, err)
+	}
+}
+
+func mustKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,64 @@
+package rproxy
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// dialFailed takes a container which could not be dialed out of rotation. It returns after Quarantine,
+// or after BreakerCooldown once it failed BreakerThreshold dials in a row (the circuit breaker is open).
+func (f *Function) dialFailed(containerIP string) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	if !slices.Contains(f.usedIPs, containerIP) {
+		return
+	}
+	f.usedIPs = remove(f.usedIPs, containerIP)
+
+	if f.draining[containerIP] {
+		delete(f.draining, containerIP)
+		delete(f.lastUsed, containerIP)
+		delete(f.dialFailures, containerIP)
+		return
+	}
+
+	f.dialFailures[containerIP]++
+	cooldown := f.settings.Quarantine
+	if f.dialFailures[containerIP] >= f.settings.BreakerThreshold {
+		cooldown = f.settings.BreakerCooldown
+		log.Printf("circuit breaker of container %s of function %s is open after %d failed dials", containerIP, f.name, f.dialFailures[containerIP])
+	}
+
+	until := time.Now().Add(cooldown)
+	f.quarantined[containerIP] = until
+	time.AfterFunc(cooldown, func() {
+		f.release(containerIP, until)
+	})
+
+	// the sessions in the queue need another container
+	f.scale()
+}
+
+// dialSucceeded closes the circuit breaker of a container
+func (f *Function) dialSucceeded(containerIP string) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	delete(f.dialFailures, containerIP)
+}
+
+// release puts a quarantined container back into rotation, unless it was removed or quarantined again in the meantime
+func (f *Function) release(containerIP string, until time.Time) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	if q, ok := f.quarantined[containerIP]; !ok || !q.Equal(until) {
+		return
+	}
+
+	log.Printf("container %s of function %s is back in rotation", containerIP, f.name)
+	delete(f.quarantined, containerIP)
+	f.addContainers([]string{containerIP})
+}
@@ -0,0 +1,95 @@
+package rproxy
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, it fails the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// failDial blocks the only container of f and fails to dial it
+func failDial(t *testing.T, f *Function) string {
+	t.Helper()
+
+	ip, err := f.getContainer(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.dialFailed(ip)
+	return ip
+}
+
+func TestDialFailedQuarantine(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Quarantine = 20 * time.Millisecond
+	settings.BreakerThreshold = 2
+	settings.BreakerCooldown = time.Hour
+	f := newTestFunction(t, settings, "10.0.0.1")
+
+	ip := failDial(t, f)
+	if s := f.status(); !slices.Equal(s.Quarantined, []string{ip}) || s.Free != 0 || s.Used != 0 {
+		t.Fatalf("expected the container to be quarantined, got %+v", s)
+	}
+
+	waitFor(t, "the container to be back in rotation", func() bool { return f.status().Free == 1 })
+
+	// the second failure in a row opens the circuit breaker
+	failDial(t, f)
+	time.Sleep(5 * settings.Quarantine)
+	if s := f.status(); !slices.Equal(s.Quarantined, []string{ip}) {
+		t.Fatalf("expected the open breaker to keep the container out of rotation, got %+v", s)
+	}
+}
+
+func TestDialSucceededClosesBreaker(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Quarantine = 20 * time.Millisecond
+	settings.BreakerThreshold = 2
+	settings.BreakerCooldown = time.Hour
+	f := newTestFunction(t, settings, "10.0.0.1")
+
+	failDial(t, f)
+	waitFor(t, "the container to be back in rotation", func() bool { return f.status().Free == 1 })
+
+	ip, err := f.getContainer(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.dialSucceeded(ip)
+	f.freeContainer(ip)
+
+	// a single failure after a successful dial only quarantines the container
+	failDial(t, f)
+	waitFor(t, "the container to be back in rotation", func() bool { return f.status().Free == 1 })
+}
+
+func TestDialFailedRemovedContainer(t *testing.T) {
+	f := newTestFunction(t, DefaultSettings(), "10.0.0.1")
+
+	ip, err := f.getContainer(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.hl.Lock()
+	f.removeEndpoints([]string{ip})
+	f.hl.Unlock()
+
+	f.dialFailed(ip)
+	if s := f.status(); len(s.Quarantined) != 0 || len(s.Draining) != 0 || len(s.Endpoints) != 0 {
+		t.Fatalf("expected the removed container to be dropped, got %+v", s)
+	}
+}
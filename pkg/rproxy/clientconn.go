@@ -0,0 +1,116 @@
+package rproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxWatchBuffer bounds the bytes a client may send while its session waits for a container,
+// once it is reached the connection is not watched anymore
+const maxWatchBuffer = 64 * 1024
+
+// watchingWriter hands out the hijacked connection of a session as a watchedConn, the request context
+// is not canceled anymore once the connection is hijacked
+type watchingWriter struct {
+	http.ResponseWriter
+	gone context.CancelFunc
+	conn *watchedConn
+}
+
+func (w *watchingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = watchConn(conn, w.gone)
+	return w.conn, brw, nil
+}
+
+// watchedConn reads the connection of a client while its session waits for a container and dials it,
+// so the session stops once the client is gone. The bytes read in the meantime are returned by Read first.
+type watchedConn struct {
+	net.Conn
+	gone context.CancelFunc
+	// closed once the watch stopped reading
+	done    chan struct{}
+	stop    sync.Once
+	mtx     sync.Mutex
+	buf     []byte
+	readErr error
+}
+
+func watchConn(conn net.Conn, gone context.CancelFunc) *watchedConn {
+	c := &watchedConn{
+		Conn: conn,
+		gone: gone,
+		done: make(chan struct{}),
+	}
+
+	go c.watch()
+	return c
+}
+
+// watch reads from the connection until unwatch is called, the client is gone or it sent too much
+func (c *watchedConn) watch() {
+	defer close(c.done)
+
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Conn.Read(b)
+
+		c.mtx.Lock()
+		c.buf = append(c.buf, b[:n]...)
+		full := len(c.buf) >= maxWatchBuffer
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			c.readErr = err
+		}
+		c.mtx.Unlock()
+
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				c.gone()
+			}
+			return
+		}
+
+		if full {
+			return
+		}
+	}
+}
+
+// unwatch stops reading the connection, afterward Read reads from it again
+func (c *watchedConn) unwatch() {
+	c.stop.Do(func() {
+		// aborts the pending read of the watch
+		c.Conn.SetReadDeadline(time.Now())
+		<-c.done
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	c.unwatch()
+
+	c.mtx.Lock()
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		c.mtx.Unlock()
+		return n, nil
+	}
+	err := c.readErr
+	c.mtx.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
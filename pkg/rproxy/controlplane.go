@@ -0,0 +1,57 @@
+package rproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const (
+	// InternalTokenEnv is the environment variable the control plane passes the internal credential in,
+	// the proxy authenticates with it at the control plane and requires it on its config endpoint
+	InternalTokenEnv = "AUBE_INTERNAL_TOKEN"
+)
+
+// controlPlane is the client of the internal endpoints of the control plane
+type controlPlane struct {
+	addr   string
+	client *http.Client
+	// token is the internal credential of the proxy, it is empty if the control plane does not require one
+	token string
+}
+
+// post sends d as JSON to an internal endpoint of the control plane
+func (c *controlPlane) post(path string, d any) (*http.Response, error) {
+	b := new(bytes.Buffer)
+	err := json.NewEncoder(b).Encode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("now sending a http.Post to \"%s%s\"", c.addr, path)
+
+	req, err := http.NewRequest(http.MethodPost, c.addr+path, b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	return c.client.Do(req)
+}
+
+// SetInternalToken sets the credential the proxy authenticates with at the control plane.
+// It must be called before the proxy serves sessions.
+func (r *RProxy) SetInternalToken(token string) {
+	r.cp.token = token
+}
+
+// SetControlPlane sets the address (e.g. https://localhost:8090) of the control plane and the client
+// used for its internal endpoints, e.g. with a TLS config. It must be called before the proxy serves sessions.
+func (r *RProxy) SetControlPlane(addr string, client *http.Client) {
+	r.cp.addr = addr
+	r.cp.client = client
+}
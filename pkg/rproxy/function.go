@@ -1,40 +1,103 @@
 package rproxy
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"maps"
 	"net/http"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	UrlPrefix    = "ws"
 	FunctionPort = 8000
+	// ControlPlaneAddr is the address of the control plane's internal endpoints
+	ControlPlaneAddr = "http://localhost:8090"
 )
 
+var (
+	// ErrQueueFull is returned if too many sessions are already waiting for a container of the function
+	ErrQueueFull = errors.New("wait queue of the function is full")
+	// ErrQueueTimeout is returned if no container became free while the session was waiting
+	ErrQueueTimeout = errors.New("timed out waiting for a free container")
+)
+
+// waiter is a session waiting for a free container, it gets the ip of its container through ch
+type waiter struct {
+	ch        chan string
+	clientKey string
+}
+
 // Function will be added soon -> Multi-Tenancy
 type Function struct {
 	name string
+	// owner is the function the backend belongs to, e.g. the function of a deployment, sessions on it are
+	// authenticated with the credentials of the owner. It does not change once the function was added.
+	owner    string
+	settings Settings
 	// uniqueContainerName -> IP
-	//maybe add a Timestamp in the Future and an async clean-up
 	freeIPs []string
 	usedIPs []string
-	hl      sync.RWMutex
+	// containerIP -> last time a session on the container ended (or the container was added)
+	lastUsed map[string]time.Time
+	// containers which were removed while serving a session, they are dropped once the session ends
+	draining map[string]bool
+	// containers which are out of rotation after failed dials until the given time, see breaker.go
+	quarantined map[string]time.Time
+	// failed dials in a row per container
+	dialFailures map[string]int
+	// session token -> container of the session, see affinity.go
+	affinities map[string]*affinity
+	// containers held for a session which may resume, containerIP -> session token
+	reserved map[string]string
+	// sessions waiting for a free container in arrival order
+	waiting []*waiter
+	// only a single scale-out is in flight, every waiting session profits from it
+	scaling bool
+	// decaying arrival rate of sessions per second, as of lastArrival
+	arrivalRate float64
+	lastArrival time.Time
+	// how long the last successful scale-out took
+	scaleLatency time.Duration
+	// client of the internal endpoints of the control plane, shared by the functions of a proxy
+	cp *controlPlane
+	// outcomes of the sessions routed to the function, e.g. to judge the canary of a route
+	sessions    atomic.Uint64
+	failures    atomic.Uint64
+	disconnects atomic.Uint64
+	hl          sync.RWMutex
 }
 
-func NewFunction(name string, ips []string) *Function {
+func NewFunction(name string, ips []string, settings Settings) *Function {
+	lastUsed := make(map[string]time.Time, len(ips))
+	for _, ip := range ips {
+		lastUsed[ip] = time.Now()
+	}
+
 	return &Function{
-		name:    name,
-		freeIPs: ips,
-		usedIPs: make([]string, 0),
-		hl:      sync.RWMutex{},
+		name:         name,
+		owner:        name,
+		settings:     settings,
+		freeIPs:      ips,
+		usedIPs:      make([]string, 0),
+		lastUsed:     lastUsed,
+		draining:     make(map[string]bool),
+		waiting:      make([]*waiter, 0),
+		quarantined:  make(map[string]time.Time),
+		dialFailures: make(map[string]int),
+		affinities:   make(map[string]*affinity),
+		reserved:     make(map[string]string),
+		cp:           &controlPlane{addr: ControlPlaneAddr, client: http.DefaultClient},
+		hl:           sync.RWMutex{},
 	}
 }
 
+// useContainer marks a free container as used, f.hl must be held
 func (f *Function) useContainer(containerIP string) error {
 	if !slices.Contains(f.freeIPs, containerIP) {
 		return fmt.Errorf("%s not found in free container list", containerIP)
@@ -45,7 +108,6 @@ func (f *Function) useContainer(containerIP string) error {
 	}
 
 	log.Printf("successfully passed checks")
-	f.hl.Lock()
 
 	log.Printf("BEFORE: container lists of function: FREE: %v, USED: %v", f.freeIPs, f.usedIPs)
 
@@ -54,13 +116,18 @@ func (f *Function) useContainer(containerIP string) error {
 
 	log.Printf("AFTER: container lists of function: FREE: %v, USED: %v", f.freeIPs, f.usedIPs)
 
-	f.hl.Unlock()
-
 	return nil
 }
 
 func (f *Function) freeContainer(containerIP string) error {
+	f.hl.Lock()
+	defer f.hl.Unlock()
 
+	return f.free(containerIP)
+}
+
+// free moves a used container back to the free containers, f.hl must be held
+func (f *Function) free(containerIP string) error {
 	if !slices.Contains(f.usedIPs, containerIP) {
 		return fmt.Errorf("%s not found in used containers", containerIP)
 	}
@@ -69,88 +136,322 @@ func (f *Function) freeContainer(containerIP string) error {
 		return fmt.Errorf("%s is not in used containers but in free containers", containerIP)
 	}
 
-	f.hl.Lock()
-
 	f.usedIPs = remove(f.usedIPs, containerIP)
+
+	if f.draining[containerIP] {
+		log.Printf("session on removed container %s of function %s ended, dropping it", containerIP, f.name)
+		delete(f.draining, containerIP)
+		delete(f.lastUsed, containerIP)
+		return nil
+	}
+
 	f.freeIPs = append(f.freeIPs, containerIP)
+	f.lastUsed[containerIP] = time.Now()
 
-	f.hl.Unlock()
+	f.handOver()
 
 	return nil
 }
 
-func (f *Function) getContainer() (string, error) {
+// addEndpoints adds containers to the function, containers which are already known are skipped, f.hl must be held
+func (f *Function) addEndpoints(ips []string) {
+	added := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if f.draining[ip] {
+			// removed and added again while serving a session, so it simply stays
+			delete(f.draining, ip)
+			continue
+		}
+
+		if _, ok := f.quarantined[ip]; ok {
+			continue
+		}
+
+		if _, ok := f.reserved[ip]; ok {
+			continue
+		}
+
+		if slices.Contains(f.freeIPs, ip) || slices.Contains(f.usedIPs, ip) || slices.Contains(added, ip) {
+			continue
+		}
+		added = append(added, ip)
+	}
+
+	f.addContainers(added)
+}
+
+// removeEndpoints removes containers from the function, unknown containers are skipped.
+// Containers serving a session are dropped once the session ends, f.hl must be held.
+func (f *Function) removeEndpoints(ips []string) {
+	for _, ip := range ips {
+		switch {
+		case slices.Contains(f.freeIPs, ip):
+			f.freeIPs = remove(f.freeIPs, ip)
+			delete(f.lastUsed, ip)
+		case slices.Contains(f.usedIPs, ip):
+			f.draining[ip] = true
+		}
+
+		if _, ok := f.quarantined[ip]; ok {
+			delete(f.quarantined, ip)
+			delete(f.lastUsed, ip)
+		}
+
+		if _, ok := f.reserved[ip]; ok {
+			f.unreserve(ip)
+			delete(f.lastUsed, ip)
+		}
+		delete(f.dialFailures, ip)
+	}
+}
+
+// setEndpoints makes ips the containers of the function, keeping the state of the ones it already knows
+func (f *Function) setEndpoints(ips []string) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	stale := make([]string, 0)
+	for _, ip := range slices.Concat(f.freeIPs, f.usedIPs, slices.Collect(maps.Keys(f.quarantined)), slices.Collect(maps.Keys(f.reserved))) {
+		if !slices.Contains(ips, ip) {
+			stale = append(stale, ip)
+		}
+	}
+
+	f.removeEndpoints(stale)
+	f.addEndpoints(ips)
+}
+
+func (f *Function) getSettings() Settings {
+	f.hl.RLock()
+	defer f.hl.RUnlock()
+
+	return f.settings
+}
+
+func (f *Function) setSettings(settings Settings) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	f.settings = settings
+}
+
+// handOver passes free containers to the waiting sessions in arrival order, f.hl must be held
+func (f *Function) handOver() {
+	for len(f.waiting) > 0 && len(f.freeIPs) > 0 {
+		w := f.waiting[0]
+
+		containerIP := f.selectContainer(w.clientKey)
+		err := f.useContainer(containerIP)
+		if err != nil {
+			// the session stays at the head of the queue, the container is already serving another one
+			log.Printf("not able to hand over container %s: %v", containerIP, err)
+			f.freeIPs = remove(f.freeIPs, containerIP)
+			continue
+		}
+
+		// buffered, the session picks it up even if it timed out in the meantime
+		f.waiting = f.waiting[1:]
+		w.ch <- containerIP
+	}
+}
+
+// addContainers adds new containers to the free list and hands them to waiting sessions, f.hl must be held
+func (f *Function) addContainers(ips []string) {
+	f.freeIPs = append(f.freeIPs, ips...)
+	for _, ip := range ips {
+		f.lastUsed[ip] = time.Now()
+	}
+
+	f.handOver()
+}
+
+// inUse returns the amount of containers which are currently serving a session
+func (f *Function) inUse() int {
+	f.hl.RLock()
+	defer f.hl.RUnlock()
+
+	return len(f.usedIPs)
+}
+
+func (f *Function) status() FunctionStatus {
+	f.hl.RLock()
+	defer f.hl.RUnlock()
+
+	endpoints := make([]string, 0, len(f.freeIPs)+len(f.usedIPs)+len(f.quarantined)+len(f.reserved))
+	for _, ip := range slices.Concat(f.freeIPs, f.usedIPs, slices.Collect(maps.Keys(f.quarantined)), slices.Collect(maps.Keys(f.reserved))) {
+		if !f.draining[ip] {
+			endpoints = append(endpoints, ip)
+		}
+	}
+	slices.Sort(endpoints)
+
+	return FunctionStatus{
+		Free:        len(f.freeIPs),
+		Used:        len(f.usedIPs),
+		Queued:      len(f.waiting),
+		ArrivalRate: f.rate(time.Now()),
+		Draining:    slices.Sorted(maps.Keys(f.draining)),
+		Quarantined: slices.Sorted(maps.Keys(f.quarantined)),
+		Reserved:    slices.Sorted(maps.Keys(f.reserved)),
+		Endpoints:   endpoints,
+		Sessions:    f.sessions.Load(),
+		Errors:      f.failures.Load(),
+		Disconnects: f.disconnects.Load(),
+		Settings:    f.settings,
+	}
+}
+
+// selectContainer picks one of the free containers with the strategy of the function, f.hl must be held
+func (f *Function) selectContainer(clientKey string) string {
+	strategy, ok := strategies[f.settings.Strategy]
+	if !ok {
+		strategy = randomStrategy{}
+	}
+
+	return strategy.Select(f.freeIPs, f.lastUsed, clientKey)
+}
+
+// getContainer blocks a free container of the function for a session. If there is none, the session
+// waits in a FIFO queue for a container which becomes free or is added by a scale-out.
+// clientKey identifies the client of the session for the strategy, it may be empty.
+// The session stops waiting once ctx is done, e.g. the client went away or the dial deadline passed.
+func (f *Function) getContainer(ctx context.Context, clientKey string) (string, error) {
+	f.hl.Lock()
 	log.Printf("trying to get a free container: %v", f.freeIPs)
+	f.arrive(time.Now())
+
+	// nobody is waiting in front of this session
+	if len(f.waiting) == 0 && len(f.freeIPs) > 0 {
+		containerIP := f.selectContainer(clientKey)
 
-	if len(f.freeIPs) == 0 {
-		log.Printf("now trying to scale the function")
-		err := f.scaleFunction()
+		// Block the container straight up
+		err := f.useContainer(containerIP)
+		// scale ahead, so the next sessions find a free container
+		f.scale()
+		f.hl.Unlock()
 		if err != nil {
-			log.Printf("error scaling the function")
 			return "", err
 		}
+
+		return containerIP, nil
 	}
 
-	containerIP := f.freeIPs[rand.Intn(len(f.freeIPs))]
+	if len(f.waiting) >= f.settings.QueueSize {
+		f.hl.Unlock()
+		log.Printf("wait queue of function %s is full (%d sessions)", f.name, len(f.waiting))
+		return "", ErrQueueFull
+	}
 
-	// Block the container straight up
-	err := f.useContainer(containerIP)
-	if err != nil {
-		return "", err
+	if len(f.freeIPs) == 0 && len(f.usedIPs) == 0 {
+		// the reaper scaled the function to zero, so this is a cold start
+		log.Printf("function %s has no containers, waking it up", f.name)
+	}
+
+	w := &waiter{
+		ch:        make(chan string, 1),
+		clientKey: clientKey,
+	}
+	f.waiting = append(f.waiting, w)
+	f.scale()
+	f.hl.Unlock()
+
+	timer := time.NewTimer(f.settings.QueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case containerIP := <-w.ch:
+		return containerIP, nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
 
-	// Build the proper function URL
-	url := fmt.Sprintf("%s://%s:%d", UrlPrefix, containerIP, FunctionPort)
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	if !slices.Contains(f.waiting, w) {
+		// a container was handed over right before the timeout
+		select {
+		case containerIP := <-w.ch:
+			return containerIP, nil
+		default:
+		}
+	}
 
-	return url, nil
+	f.waiting = remove(f.waiting, w)
+	log.Printf("session stopped waiting for a container of function %s: %v", f.name, err)
+	return "", err
 }
 
-func (f *Function) scaleFunction() error {
+// containerURL builds the proper function URL
+func containerURL(containerIP string) string {
+	return fmt.Sprintf("%s://%s:%d", UrlPrefix, containerIP, FunctionPort)
+}
 
-	b := new(bytes.Buffer)
-	d := struct {
-		FunctionName string `json:"name"`
-		Amount       int    `json:"amount"`
-	}{
-		FunctionName: f.name,
-		Amount:       1, //Optimization later
-	}
+// idleContainers removes free containers which have not been used for longer than idleTTL
+// from the function, the oldest first, but keeps at least minWarm containers in total.
+func (f *Function) idleContainers(idleTTL time.Duration, minWarm int) []string {
+	f.hl.Lock()
+	defer f.hl.Unlock()
 
-	err := json.NewEncoder(b).Encode(d)
-	if err != nil {
-		return err
+	candidates := make([]string, 0)
+	for _, ip := range f.freeIPs {
+		if time.Since(f.lastUsed[ip]) > idleTTL {
+			candidates = append(candidates, ip)
+		}
 	}
 
-	log.Printf("now sending a http.Post to \"http://localhost:8090/scale\"")
+	slices.SortFunc(candidates, func(a, b string) int {
+		return f.lastUsed[a].Compare(f.lastUsed[b])
+	})
 
-	resp, err := http.Post("http://localhost:8090/scale", "application/json", b)
-	if err != nil || resp == nil {
-		log.Printf("error in response")
-		return fmt.Errorf("resp nil or err: %v", err)
+	idle := make([]string, 0, len(candidates))
+	for _, ip := range candidates {
+		if len(f.freeIPs)+len(f.usedIPs) <= minWarm {
+			break
+		}
+		f.freeIPs = remove(f.freeIPs, ip)
+		delete(f.lastUsed, ip)
+		idle = append(idle, ip)
 	}
 
-	log.Printf("received this response from cp: %v", resp.StatusCode)
+	return idle
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("not able to scale the function received http status code: %v", resp.StatusCode)
+// restoreContainers puts containers back into the free list, if the control plane was not able to remove them
+func (f *Function) restoreContainers(ips []string, lastUsed time.Time) {
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	for _, ip := range ips {
+		f.freeIPs = append(f.freeIPs, ip)
+		f.lastUsed[ip] = lastUsed
 	}
 
-	r := struct {
-		NewIPs []string `json:"ips"`
-	}{}
+	f.handOver()
+}
+
+// releaseContainers asks the control plane to remove the given containers of the function
+func (f *Function) releaseContainers(ips []string) error {
+	d := struct {
+		FunctionName string   `json:"name"`
+		IPs          []string `json:"ips"`
+	}{
+		FunctionName: f.name,
+		IPs:          ips,
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&r)
+	resp, err := f.cp.post("/scalein", d)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	log.Printf("decoded response into r: %v", r)
-
-	log.Printf("free_ips before update should be: [], is: %v", f.freeIPs)
-	// Add the new IPs to the freeIPs
-	f.freeIPs = append(f.freeIPs, r.NewIPs...)
-
-	log.Printf("free_ips before update should be not: [], is: %v", f.freeIPs)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not able to release containers received http status code: %v", resp.StatusCode)
+	}
 
 	return nil
 }
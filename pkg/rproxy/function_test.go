@@ -0,0 +1,180 @@
+package rproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestFunction returns a function whose scale-outs are answered without new containers
+func newTestFunction(t *testing.T, settings Settings, ips ...string) *Function {
+	t.Helper()
+
+	cp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ips":[]}`))
+	}))
+	t.Cleanup(cp.Close)
+
+	f := NewFunction("echo", ips, settings)
+	f.cp = &controlPlane{addr: cp.URL, client: cp.Client()}
+	return f
+}
+
+// result is what getContainer returned to a session
+type result struct {
+	ip  string
+	err error
+}
+
+// queue lets a session wait for a container of f and returns once it is queued
+func queue(t *testing.T, ctx context.Context, f *Function, clientKey string) <-chan result {
+	t.Helper()
+
+	queued := f.status().Queued
+	ch := make(chan result, 1)
+	go func() {
+		ip, err := f.getContainer(ctx, clientKey)
+		ch <- result{ip, err}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for f.status().Queued == queued {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return ch
+}
+
+// await returns the result of a session, it fails the test if the session blocks
+func await(t *testing.T, ch <-chan result) result {
+	t.Helper()
+
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("session is blocked")
+		return result{}
+	}
+}
+
+func TestGetContainerFree(t *testing.T) {
+	f := newTestFunction(t, DefaultSettings(), "10.0.0.1")
+
+	ip, err := f.getContainer(context.Background(), "")
+	if err != nil || ip != "10.0.0.1" {
+		t.Fatalf("expected the free container, got %q, %v", ip, err)
+	}
+
+	if s := f.status(); s.Free != 0 || s.Used != 1 {
+		t.Fatalf("expected the container to be used, got %+v", s)
+	}
+}
+
+func TestGetContainerFIFO(t *testing.T) {
+	f := newTestFunction(t, DefaultSettings())
+
+	first := queue(t, context.Background(), f, "")
+	second := queue(t, context.Background(), f, "")
+
+	f.hl.Lock()
+	f.addContainers([]string{"10.0.0.1"})
+	f.hl.Unlock()
+
+	if r := await(t, first); r.err != nil || r.ip != "10.0.0.1" {
+		t.Fatalf("expected the first session to get the container, got %+v", r)
+	}
+
+	err := f.freeContainer("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := await(t, second); r.err != nil || r.ip != "10.0.0.1" {
+		t.Fatalf("expected the second session to get the freed container, got %+v", r)
+	}
+}
+
+func TestGetContainerQueueFull(t *testing.T) {
+	settings := DefaultSettings()
+	settings.QueueSize = 1
+	f := newTestFunction(t, settings)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue(t, ctx, f, "")
+
+	_, err := f.getContainer(context.Background(), "")
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+}
+
+func TestGetContainerTimeout(t *testing.T) {
+	settings := DefaultSettings()
+	settings.QueueTimeout = 10 * time.Millisecond
+	f := newTestFunction(t, settings)
+
+	_, err := f.getContainer(context.Background(), "")
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected %v, got %v", ErrQueueTimeout, err)
+	}
+
+	if s := f.status(); s.Queued != 0 {
+		t.Fatalf("expected the session to leave the queue, got %+v", s)
+	}
+}
+
+func TestGetContainerCanceled(t *testing.T) {
+	f := newTestFunction(t, DefaultSettings())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := queue(t, ctx, f, "")
+	cancel()
+
+	if r := await(t, ch); !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("expected %v, got %+v", context.Canceled, r)
+	}
+
+	if s := f.status(); s.Queued != 0 {
+		t.Fatalf("expected the session to leave the queue, got %+v", s)
+	}
+}
+
+// A container which can't be handed over must not take the session out of the queue,
+// otherwise the session blocks on its channel once it times out and holds the function lock.
+func TestHandOverUsedContainer(t *testing.T) {
+	settings := DefaultSettings()
+	settings.QueueTimeout = 50 * time.Millisecond
+	f := newTestFunction(t, settings, "10.0.0.1")
+
+	_, err := f.getContainer(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := queue(t, context.Background(), f, "")
+
+	// e.g. a scale-out returns a container which is still serving a session
+	f.hl.Lock()
+	f.addContainers([]string{"10.0.0.1"})
+	queued := len(f.waiting)
+	f.hl.Unlock()
+
+	if queued != 1 {
+		t.Fatalf("expected the session to stay queued, %d are queued", queued)
+	}
+
+	if r := await(t, ch); !errors.Is(r.err, ErrQueueTimeout) {
+		t.Fatalf("expected %v, got %+v", ErrQueueTimeout, r)
+	}
+
+	if s := f.status(); s.Free != 0 || s.Used != 1 || s.Queued != 0 {
+		t.Fatalf("unexpected containers %+v", s)
+	}
+}
@@ -0,0 +1,118 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes of sessions which hit a limit, see Settings
+const (
+	// CloseIdle ends a session without messages for IdleTimeout
+	CloseIdle = websocket.CloseGoingAway
+	// CloseLimit ends a session which exceeded MaxDuration or MaxBytes or did not take its messages within WriteTimeout
+	CloseLimit = websocket.ClosePolicyViolation
+	// CloseTooBig ends a session which sent a message larger than MaxMessageSize
+	CloseTooBig = websocket.CloseMessageTooBig
+)
+
+// limited reports whether the settings limit sessions, limits are enforced by the frames relay
+func (s Settings) limited() bool {
+	return s.IdleTimeout > 0 || s.WriteTimeout > 0 || s.MaxDuration > 0 || s.MaxMessageSize > 0 || s.MaxBytes > 0
+}
+
+// limiter enforces the limits of the settings on a session of the frames relay
+type limiter struct {
+	settings Settings
+	// unix nanoseconds of the last message in either direction
+	lastActive atomic.Int64
+	// payload of the messages in both directions
+	bytes atomic.Int64
+}
+
+func newLimiter(settings Settings) *limiter {
+	l := &limiter{settings: settings}
+	l.lastActive.Store(time.Now().UnixNano())
+	return l
+}
+
+// apply sets the read limit of a connection, larger messages make ReadMessage fail with ErrReadLimit
+func (l *limiter) apply(conn *websocket.Conn) {
+	if l.settings.MaxMessageSize > 0 {
+		conn.SetReadLimit(l.settings.MaxMessageSize)
+	}
+}
+
+// read accounts a message, it returns a close error if the session exceeded MaxBytes
+func (l *limiter) read(n int) error {
+	l.lastActive.Store(time.Now().UnixNano())
+
+	total := l.bytes.Add(int64(n))
+	if l.settings.MaxBytes > 0 && total > l.settings.MaxBytes {
+		return &websocket.CloseError{Code: CloseLimit, Text: fmt.Sprintf("session exceeded %d bytes", l.settings.MaxBytes)}
+	}
+
+	return nil
+}
+
+// write sets the deadline of the next message written to conn
+func (l *limiter) write(conn *websocket.Conn) {
+	if l.settings.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(l.settings.WriteTimeout))
+	}
+}
+
+// idle returns how long the session has been without messages
+func (l *limiter) idle() time.Duration {
+	return time.Since(time.Unix(0, l.lastActive.Load()))
+}
+
+// limitError turns the errors of a connection which hit a limit into the close error ending the session.
+// ok is false for other errors.
+func (l *limiter) limitError(err error) (*websocket.CloseError, bool) {
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		return &websocket.CloseError{Code: CloseTooBig, Text: fmt.Sprintf("message exceeded %d bytes", l.settings.MaxMessageSize)}, true
+	case l.settings.WriteTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded):
+		return &websocket.CloseError{Code: CloseLimit, Text: fmt.Sprintf("message not taken within %v", l.settings.WriteTimeout)}, true
+	}
+
+	return nil, false
+}
+
+// watch waits for the end of a direction of the session, unless the session is idle for IdleTimeout
+// or reaches MaxDuration first
+func (l *limiter) watch(ends <-chan relayEnd, started time.Time) relayEnd {
+	var idle <-chan time.Time
+	if l.settings.IdleTimeout > 0 {
+		timer := time.NewTimer(l.settings.IdleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	var deadline <-chan time.Time
+	if l.settings.MaxDuration > 0 {
+		timer := time.NewTimer(l.settings.MaxDuration - time.Since(started))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case end := <-ends:
+			return end
+		case <-deadline:
+			return relayEnd{closing: true, err: &websocket.CloseError{Code: CloseLimit, Text: fmt.Sprintf("session reached the maximum duration of %v", l.settings.MaxDuration)}}
+		case <-idle:
+			idleFor := l.idle()
+			if idleFor >= l.settings.IdleTimeout {
+				return relayEnd{closing: true, err: &websocket.CloseError{Code: CloseIdle, Text: fmt.Sprintf("session idle for %v", l.settings.IdleTimeout)}}
+			}
+			idle = time.After(l.settings.IdleTimeout - idleFor)
+		}
+	}
+}
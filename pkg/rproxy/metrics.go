@@ -0,0 +1,45 @@
+package rproxy
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+)
+
+// WriteMetrics writes the registry of the proxy in the prometheus text format
+func (r *RProxy) WriteMetrics(w io.Writer) error {
+	status := r.Status()
+	names := slices.Sorted(maps.Keys(status))
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(FunctionStatus) float64
+	}{
+		{"aube_rproxy_free_containers", "gauge", "Containers of the function which are not in use.", func(s FunctionStatus) float64 { return float64(s.Free) }},
+		{"aube_rproxy_used_containers", "gauge", "Containers of the function with an active session.", func(s FunctionStatus) float64 { return float64(s.Used) }},
+		{"aube_rproxy_queue_depth", "gauge", "Sessions waiting for a free container of the function.", func(s FunctionStatus) float64 { return float64(s.Queued) }},
+		{"aube_rproxy_arrival_rate", "gauge", "Observed rate of new sessions of the function per second.", func(s FunctionStatus) float64 { return s.ArrivalRate }},
+		{"aube_rproxy_sessions_total", "counter", "Sessions routed to the function.", func(s FunctionStatus) float64 { return float64(s.Sessions) }},
+		{"aube_rproxy_errors_total", "counter", "Sessions of the function which did not reach a container.", func(s FunctionStatus) float64 { return float64(s.Errors) }},
+		{"aube_rproxy_disconnects_total", "counter", "Sessions of the function which ended with an error.", func(s FunctionStatus) float64 { return float64(s.Disconnects) }},
+	}
+
+	for _, g := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, g.kind)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			_, err = fmt.Fprintf(w, "%s{function=%q} %g\n", g.name, name, g.value(status[name]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package rproxy
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// MaxReapInterval bounds the time between two runs of the reaper
+	MaxReapInterval = 30 * time.Second
+)
+
+// StartReaper periodically shuts down containers which have been idle for longer than idleTTL.
+// At least minWarm containers are kept per function, with minWarm = 0 a function scales to zero
+// and is woken up again by the next request.
+func (r *RProxy) StartReaper(idleTTL time.Duration, minWarm int) {
+	interval := min(idleTTL, MaxReapInterval)
+
+	log.Printf("starting reaper with idle ttl: %v, min warm containers: %d", idleTTL, minWarm)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.reap(idleTTL, minWarm)
+		}
+	}()
+}
+
+func (r *RProxy) reap(idleTTL time.Duration, minWarm int) {
+	r.hl.RLock()
+	functions := make([]*Function, 0, len(r.hosts))
+	for _, f := range r.hosts {
+		functions = append(functions, f)
+	}
+	r.hl.RUnlock()
+
+	for _, f := range functions {
+		idle := f.idleContainers(idleTTL, minWarm)
+		if len(idle) == 0 {
+			continue
+		}
+
+		log.Printf("releasing idle containers of function %s: %v", f.name, idle)
+
+		err := f.releaseContainers(idle)
+		if err != nil {
+			// the containers are still running, so we can hand them out again and retry on the next run
+			log.Printf("releasing idle containers of function %s failed with err: %v", f.name, err)
+			f.restoreContainers(idle, time.Now().Add(-idleTTL))
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package rproxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// RelayRaw copies the bytes of a session between the connections, the proxy does not see messages
+	RelayRaw = "raw"
+	// RelayFrames relays a session message by message, so hooks can inspect them
+	RelayFrames = "frames"
+	// CloseGrace is how long the relay waits for the close handshake of the other side of a session
+	CloseGrace = time.Second
+	// MaxCloseText is the maximum length of the reason in a close frame
+	MaxCloseText = 123
+)
+
+// Direction is the direction a message of a session travels in
+type Direction int
+
+const (
+	ClientToFunction Direction = iota
+	FunctionToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToFunction {
+		return "client to function"
+	}
+	return "function to client"
+}
+
+// Session is a session relayed message by message, every hook gets it along with the messages
+type Session struct {
+	// Function is the name of the function serving the session, Container the ip of its container
+	Function  string
+	Container string
+	// Token is the session token, it is empty if the function does not issue tokens
+	Token string
+	// Principal is the authenticated client of the session
+	Principal Principal
+	Started   time.Time
+	// Request is the upgrade request of the client
+	Request *http.Request
+}
+
+// Hook is called by the frames relay for the messages of every session. Pings, pongs and close frames
+// are forwarded without the hooks.
+type Hook interface {
+	// Message is called for every text and binary message before it is forwarded, the returned payload
+	// is forwarded instead. An error closes the session, with the code of a *websocket.CloseError or
+	// 1011 (internal error) otherwise.
+	Message(s *Session, dir Direction, messageType int, data []byte) ([]byte, error)
+	// Closed is called once the session ended with the close code the relay saw or sent
+	Closed(s *Session, code int, text string)
+}
+
+// Use adds a hook to every session relayed with the frames relay, hooks run in the order they were added
+func (r *RProxy) Use(h Hook) {
+	r.hl.Lock()
+	defer r.hl.Unlock()
+
+	r.hooks = append(r.hooks, h)
+}
+
+// relayRaw copies the bytes between the underlying connections until one side closes
+func relayRaw(clientConn, functionConn *websocket.Conn) error {
+	// Get underlying network connections for io.Copy
+	clientNetConn := clientConn.NetConn()
+	fnNetConn := functionConn.NetConn()
+
+	log.Printf("the underlying connection are of Type: %T, %T", clientNetConn, fnNetConn)
+
+	errChan := make(chan error, 2)
+
+	// Client -> Function
+	go func() {
+		// Write -> WriteTo, Reader -> ReadFrom
+		_, err := io.Copy(fnNetConn, clientNetConn)
+		log.Printf("client to function stream closed: %v", err)
+		errChan <- err
+	}()
+
+	// Function -> Client
+	go func() {
+		_, err := io.Copy(clientNetConn, fnNetConn)
+		log.Printf("function to client stream closed: %v", err)
+		errChan <- err
+	}()
+
+	return <-errChan
+}
+
+// relayEnd is the reason a direction of a session stopped
+type relayEnd struct {
+	dir Direction
+	err error
+	// closing is set if the proxy ends the session, e.g. a hook or a limit
+	closing bool
+}
+
+// relayFrames relays the messages of a session in both directions until one side closes, a hook ends
+// the session or it hits a limit of the settings. Pings, pongs and close frames are passed on, so the client
+// and the function do the handshakes with each other. It returns nil if the session was closed normally.
+func (r *RProxy) relayFrames(s *Session, settings Settings, clientConn, functionConn *websocket.Conn) error {
+	r.hl.RLock()
+	hooks := r.hooks
+	r.hl.RUnlock()
+
+	forwardControl(clientConn, functionConn)
+	forwardControl(functionConn, clientConn)
+
+	lim := newLimiter(settings)
+	lim.apply(clientConn)
+	lim.apply(functionConn)
+
+	ends := make(chan relayEnd, 2)
+	go func() {
+		ends <- pump(s, hooks, lim, clientConn, functionConn, ClientToFunction)
+	}()
+	go func() {
+		ends <- pump(s, hooks, lim, functionConn, clientConn, FunctionToClient)
+	}()
+
+	end := lim.watch(ends, s.Started)
+	code, text, passedOn := closeCode(end)
+
+	if passedOn {
+		// the close frame was passed on, give the other side the time to answer it
+		select {
+		case <-ends:
+		case <-time.After(CloseGrace):
+		}
+	} else {
+		log.Printf("closing session on function %s: %v", s.Function, end.err)
+		msg := websocket.FormatCloseMessage(code, text)
+		deadline := time.Now().Add(CloseGrace)
+		clientConn.WriteControl(websocket.CloseMessage, msg, deadline)
+		functionConn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+
+	for _, h := range hooks {
+		h.Closed(s, code, text)
+	}
+
+	if passedOn {
+		switch code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+			return nil
+		}
+	}
+	return end.err
+}
+
+// pump reads the messages of src, runs them through the limits and hooks and writes them to dst.
+// Only pump writes data messages to dst, control frames are written concurrently with WriteControl.
+func pump(s *Session, hooks []Hook, lim *limiter, src, dst *websocket.Conn, dir Direction) relayEnd {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if ce, ok := lim.limitError(err); ok {
+			return relayEnd{dir: dir, err: ce, closing: true}
+		}
+		if err != nil {
+			return relayEnd{dir: dir, err: err}
+		}
+
+		err = lim.read(len(data))
+		if err != nil {
+			return relayEnd{dir: dir, err: err, closing: true}
+		}
+
+		for _, h := range hooks {
+			data, err = h.Message(s, dir, messageType, data)
+			if err != nil {
+				return relayEnd{dir: dir, err: err, closing: true}
+			}
+		}
+
+		lim.write(dst)
+		err = dst.WriteMessage(messageType, data)
+		if ce, ok := lim.limitError(err); ok {
+			return relayEnd{dir: dir, err: ce, closing: true}
+		}
+		if err != nil {
+			return relayEnd{dir: dir, err: err}
+		}
+	}
+}
+
+// forwardControl passes the pings, pongs and close frames src receives on to dst instead of answering them
+func forwardControl(src, dst *websocket.Conn) {
+	src.SetPingHandler(func(data string) error {
+		return ignoreClosed(dst.WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(CloseGrace)))
+	})
+	src.SetPongHandler(func(data string) error {
+		return ignoreClosed(dst.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(CloseGrace)))
+	})
+	src.SetCloseHandler(func(code int, text string) error {
+		return ignoreClosed(dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(CloseGrace)))
+	})
+}
+
+// ignoreClosed drops the error of a control frame to a side which already sent its close frame
+func ignoreClosed(err error) error {
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// closeCode returns the close code and text which end a session for the given reason.
+// passedOn reports whether a side sent a close frame, which was already passed on to the other side.
+func closeCode(end relayEnd) (code int, text string, passedOn bool) {
+	var ce *websocket.CloseError
+	isClose := errors.As(end.err, &ce)
+
+	if end.closing {
+		if isClose {
+			return ce.Code, closeText(ce.Text), false
+		}
+		return websocket.CloseInternalServerErr, closeText(end.err.Error()), false
+	}
+
+	// gorilla reports a connection which broke without a close frame as 1006
+	if isClose && ce.Code != websocket.CloseAbnormalClosure {
+		return ce.Code, ce.Text, true
+	}
+
+	if end.dir == ClientToFunction {
+		return websocket.CloseGoingAway, "client went away", false
+	}
+	return websocket.CloseInternalServerErr, "connection to the function failed", false
+}
+
+// closeText cuts text to the 123 bytes which fit into a close frame
+func closeText(text string) string {
+	if len(text) > MaxCloseText {
+		return text[:MaxCloseText]
+	}
+	return text
+}
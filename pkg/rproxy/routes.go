@@ -0,0 +1,209 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrRouteNotFound is returned if no route with the given path exists
+	ErrRouteNotFound = errors.New("route not found")
+	// ErrInvalidRoute is returned for routes without backends or with invalid weights
+	ErrInvalidRoute = errors.New("invalid route")
+)
+
+// Route splits the sessions on a path between one or more functions, e.g. the versions of a canary release
+type Route struct {
+	Backends []WeightedBackend `json:"backends"`
+	// ClientKey is the name of the header or query parameter identifying a client. If it is set,
+	// every session of a client goes to the same backend as long as the weights don't change.
+	ClientKey string `json:"clientKey,omitempty"`
+}
+
+// WeightedBackend is a function of a route, it gets Weight out of the sum of all weights of the sessions
+type WeightedBackend struct {
+	Backend string `json:"backend"`
+	Weight  int    `json:"weight"`
+}
+
+// Validate checks that the route has a backend and the weights are usable
+func (rt Route) Validate() error {
+	if len(rt.Backends) == 0 {
+		return fmt.Errorf("%w: no backends", ErrInvalidRoute)
+	}
+
+	total := 0
+	for _, b := range rt.Backends {
+		if b.Backend == "" {
+			return fmt.Errorf("%w: backend without a name", ErrInvalidRoute)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("%w: weight of %s must not be negative", ErrInvalidRoute, b.Backend)
+		}
+		total += b.Weight
+	}
+
+	if total == 0 {
+		return fmt.Errorf("%w: the weights sum up to 0", ErrInvalidRoute)
+	}
+
+	return nil
+}
+
+// pick chooses the backend of a session, by the hash of the client key if there is one and at random otherwise
+func (rt Route) pick(clientKey string) string {
+	total := 0
+	for _, b := range rt.Backends {
+		total += b.Weight
+	}
+
+	var n int
+	if clientKey != "" {
+		h := fnv.New32a()
+		h.Write([]byte(clientKey))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+
+	for _, b := range rt.Backends {
+		if n < b.Weight {
+			return b.Backend
+		}
+		n -= b.Weight
+	}
+
+	// not reachable for a validated route
+	return rt.Backends[len(rt.Backends)-1].Backend
+}
+
+// SetRoute routes new sessions on the path route to the backends of rt, e.g. an alias of a function
+// to the deployments of its versions. Sessions which already run on a previous backend are not affected.
+func (r *RProxy) SetRoute(route string, rt Route) error {
+	err := rt.Validate()
+	if err != nil {
+		return err
+	}
+
+	r.hl.Lock()
+	defer r.hl.Unlock()
+
+	for _, b := range rt.Backends {
+		if _, ok := r.hosts[b.Backend]; !ok {
+			return fmt.Errorf("backend %s: %w", b.Backend, ErrFunctionNotFound)
+		}
+	}
+
+	log.Printf("routing %s to %+v", route, rt.Backends)
+	r.routes[route] = Route{
+		Backends:  slices.Clone(rt.Backends),
+		ClientKey: rt.ClientKey,
+	}
+	return nil
+}
+
+// DelRoute removes a route, the backends it pointed to are kept
+func (r *RProxy) DelRoute(route string) error {
+	r.hl.Lock()
+	defer r.hl.Unlock()
+
+	if _, ok := r.routes[route]; !ok {
+		return ErrRouteNotFound
+	}
+
+	delete(r.routes, route)
+	return nil
+}
+
+// Routes returns every route by its path
+func (r *RProxy) Routes() map[string]Route {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	return maps.Clone(r.routes)
+}
+
+// owner returns the function whose credentials apply to sessions on the path. A route belongs to the function
+// of its first segment, a backend to the function it was registered for.
+func (r *RProxy) owner(path string) string {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	function, _, _ := strings.Cut(path, "/")
+	if _, ok := r.routes[path]; ok {
+		return function
+	}
+
+	if f, ok := r.hosts[path]; ok {
+		return f.owner
+	}
+
+	return function
+}
+
+// resolve returns the function a session on the path is served by, a route takes precedence over a backend
+// of the same name. A client which resumes a session stays on the backend holding its container, token must
+// have been verified to belong to the principal of the session.
+func (r *RProxy) resolve(path string, token string, req *http.Request) (*Function, bool) {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	rt, ok := r.routes[path]
+	if !ok {
+		f, ok := r.hosts[path]
+		return f, ok
+	}
+
+	if token != "" {
+		for _, b := range rt.Backends {
+			if f, ok := r.hosts[b.Backend]; ok && f.hasAffinity(token) {
+				return f, true
+			}
+		}
+	}
+
+	f, ok := r.hosts[rt.pick(clientKey(rt.ClientKey, req))]
+	return f, ok
+}
+
+// clientKey returns the value of the header or query parameter name of the request, if name is set
+func clientKey(name string, req *http.Request) string {
+	if name == "" {
+		return ""
+	}
+
+	if key := req.Header.Get(name); key != "" {
+		return key
+	}
+
+	return req.URL.Query().Get(name)
+}
+
+// dropRoutes removes a backend from every route, routes without backends are removed. r.hl must be held
+func (r *RProxy) dropRoutes(backend string) {
+	for route, rt := range r.routes {
+		backends := slices.DeleteFunc(slices.Clone(rt.Backends), func(b WeightedBackend) bool {
+			return b.Backend == backend
+		})
+		if len(backends) == len(rt.Backends) {
+			continue
+		}
+
+		rt.Backends = backends
+		if rt.Validate() != nil {
+			log.Printf("removing route %s of removed function %s", route, backend)
+			delete(r.routes, route)
+			continue
+		}
+
+		log.Printf("removing function %s from route %s", backend, route)
+		r.routes[route] = rt
+	}
+}
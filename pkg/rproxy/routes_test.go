@@ -0,0 +1,98 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// Routes need a named backend and weights which don't sum up to 0
+func TestRouteValidate(t *testing.T) {
+	for _, rt := range []Route{
+		{},
+		{Backends: []WeightedBackend{{Backend: "", Weight: 1}}},
+		{Backends: []WeightedBackend{{Backend: "echo-1", Weight: -1}, {Backend: "echo-2", Weight: 2}}},
+		{Backends: []WeightedBackend{{Backend: "echo-1", Weight: 0}}},
+	} {
+		if err := rt.Validate(); !errors.Is(err, ErrInvalidRoute) {
+			t.Fatalf("expected %+v to be invalid, got %v", rt.Backends, err)
+		}
+	}
+
+	rt := Route{Backends: []WeightedBackend{{Backend: "echo-1", Weight: 0}, {Backend: "echo-2", Weight: 1}}}
+	if err := rt.Validate(); err != nil {
+		t.Fatalf("expected a route with a weight of 0 on one backend to be valid, got %v", err)
+	}
+}
+
+// Sessions are split by the weights, a backend with a weight of 0 gets none
+func TestRoutePickWeights(t *testing.T) {
+	rt := Route{Backends: []WeightedBackend{
+		{Backend: "echo-1", Weight: 90},
+		{Backend: "echo-2", Weight: 10},
+		{Backend: "echo-3", Weight: 0},
+	}}
+
+	picked := make(map[string]int)
+	for range 10000 {
+		picked[rt.pick("")]++
+	}
+
+	if picked["echo-3"] != 0 {
+		t.Fatalf("expected no sessions on a backend with a weight of 0, got %d", picked["echo-3"])
+	}
+	if picked["echo-2"] < 700 || picked["echo-2"] > 1300 {
+		t.Fatalf("expected about 10%% of the sessions on echo-2, got %d of 10000", picked["echo-2"])
+	}
+
+	clients := make(map[string]int)
+	for i := range 10000 {
+		clients[rt.pick(fmt.Sprintf("client-%d", i))]++
+	}
+	if clients["echo-3"] != 0 || clients["echo-2"] < 700 || clients["echo-2"] > 1300 {
+		t.Fatalf("expected the client keys to be split by the weights, got %v", clients)
+	}
+}
+
+// Every session of a client goes to the same backend, the key is taken from the header or the query
+func TestRouteClientKey(t *testing.T) {
+	rt := Route{
+		Backends:  []WeightedBackend{{Backend: "echo-1", Weight: 1}, {Backend: "echo-2", Weight: 1}},
+		ClientKey: "X-User",
+	}
+
+	for i := range 100 {
+		user := fmt.Sprintf("user-%d", i)
+		header := httptest.NewRequest("GET", "/echo", nil)
+		header.Header.Set("X-User", user)
+		query := httptest.NewRequest("GET", "/echo?X-User="+user, nil)
+
+		backend := rt.pick(clientKey(rt.ClientKey, header))
+		for range 5 {
+			if got := rt.pick(clientKey(rt.ClientKey, header)); got != backend {
+				t.Fatalf("expected %s to stay on %s, got %s", user, backend, got)
+			}
+		}
+		if got := rt.pick(clientKey(rt.ClientKey, query)); got != backend {
+			t.Fatalf("expected %s to get the same backend by query, got %s instead of %s", user, got, backend)
+		}
+	}
+
+	if key := clientKey("", httptest.NewRequest("GET", "/echo?X-User=user-1", nil)); key != "" {
+		t.Fatalf("expected no client key without a ClientKey, got %q", key)
+	}
+}
+
+// A route can only point to registered backends
+func TestSetRouteUnknownBackend(t *testing.T) {
+	proxy, _ := newTestProxy(t, Settings{})
+
+	err := proxy.SetRoute("echo", Route{Backends: []WeightedBackend{{Backend: "echo-1", Weight: 1}}})
+	if !errors.Is(err, ErrFunctionNotFound) {
+		t.Fatalf("expected ErrFunctionNotFound, got %v", err)
+	}
+	if _, ok := proxy.Routes()["echo"]; ok {
+		t.Fatalf("expected the route not to be set")
+	}
+}
@@ -1,28 +1,106 @@
 package rproxy
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+var (
+	// ErrFunctionNotFound is returned if the function is not registered at the proxy
+	ErrFunctionNotFound = errors.New("function not found")
+	// ErrFunctionInUse is returned if a function should be removed while containers are still in use
+	ErrFunctionInUse = errors.New("function has containers in use")
+	// ErrDialFailed is returned if a session could not connect to any of the containers it tried
+	ErrDialFailed = errors.New("connecting to the containers of the function failed")
+)
+
+const (
+	// ShutdownPollInterval is the interval in which Shutdown checks for remaining sessions
+	ShutdownPollInterval = 500 * time.Millisecond
+)
+
 type RProxy struct {
-	hosts    map[string]*Function
-	hl       sync.RWMutex
+	hosts map[string]*Function
+	// routes map a path to the functions serving it, guarded by hl as well
+	routes map[string]Route
+	hl     sync.RWMutex
+	// settings of newly added functions
+	defaults Settings
+	// auth authenticates the sessions, guarded by hl
+	auth Authenticator
+	// cp is the client of the control plane shared by every function
+	cp *controlPlane
+	// hooks of the frames relay, guarded by hl
+	hooks    []Hook
 	upgrader websocket.Upgrader
+	// client connections of all active sessions
+	sessions map[*websocket.Conn]struct{}
+	draining bool
+	sl       sync.Mutex
+	// tokenKey signs the session tokens
+	tokenKey []byte
 }
 
 func (p *RProxy) GetHosts() map[string]*Function {
 	return p.hosts
 }
 
-func New() *RProxy {
+// FunctionStatus is the amount of free and used containers of a function and of waiting sessions
+type FunctionStatus struct {
+	Free   int `json:"free"`
+	Used   int `json:"used"`
+	Queued int `json:"queued"`
+	// ArrivalRate is the observed rate of new sessions per second
+	ArrivalRate float64 `json:"arrivalRate"`
+	// Draining are the ips of removed containers which still serve a session
+	Draining []string `json:"draining"`
+	// Quarantined are the ips of containers which are out of rotation after failed dials
+	Quarantined []string `json:"quarantined"`
+	// Reserved are the ips of containers held for sessions which may resume
+	Reserved []string `json:"reserved"`
+	// Endpoints are the ips of all containers of the function, except the draining ones
+	Endpoints []string `json:"endpoints"`
+	// Sessions counts the sessions routed to the function, Errors the ones which did not reach a container
+	// and Disconnects the ones which ended with an error
+	Sessions    uint64   `json:"sessions"`
+	Errors      uint64   `json:"errors"`
+	Disconnects uint64   `json:"disconnects"`
+	Settings    Settings `json:"settings"`
+}
+
+// Status returns the current registry of the proxy by function name
+func (r *RProxy) Status() map[string]FunctionStatus {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	status := make(map[string]FunctionStatus, len(r.hosts))
+	for name, f := range r.hosts {
+		status[name] = f.status()
+	}
+
+	return status
+}
+
+func New(defaults Settings) *RProxy {
+	tokenKey := make([]byte, 32)
+	rand.Read(tokenKey)
+
 	return &RProxy{
-		hosts: make(map[string]*Function),
+		hosts:    make(map[string]*Function),
+		routes:   make(map[string]Route),
+		defaults: defaults,
+		cp:       &controlPlane{addr: ControlPlaneAddr, client: http.DefaultClient},
+		sessions: make(map[*websocket.Conn]struct{}),
+		tokenKey: tokenKey,
 		upgrader: websocket.Upgrader{
 			// Allows all origins to upgrade to a stream
 			CheckOrigin: func(r *http.Request) bool { return true },
@@ -30,43 +108,209 @@ func New() *RProxy {
 	}
 }
 
-// Add takes a container name and an ip-addr of a specific function
-func (r *RProxy) Add(name string, ips []string) error {
-	log.Printf("received function %s now adding it with IPs : [%v]", name, ips)
+// FunctionStatus returns the current state of a single function
+func (r *RProxy) FunctionStatus(name string) (FunctionStatus, error) {
+	f, err := r.function(name)
+	if err != nil {
+		return FunctionStatus{}, err
+	}
+
+	return f.status(), nil
+}
 
-	f := NewFunction(name, ips)
+// Register makes ips the containers of a function and adds the function if it is not known yet.
+// Containers the function already knows keep their state, so sessions on them are not affected.
+// owner is the function the backend belongs to, e.g. the function of a deployment, it is the backend itself if empty.
+// The owner is kept once the function was added.
+func (r *RProxy) Register(name string, owner string, ips []string) {
+	log.Printf("registering function %s of %s with IPs : [%v]", name, owner, ips)
+
+	if owner == "" {
+		owner = name
+	}
 
 	r.hl.Lock()
-	defer r.hl.Unlock()
+	f, ok := r.hosts[name]
+	if !ok {
+		f = NewFunction(name, slices.Clone(ips), r.defaults)
+		f.owner = owner
+		f.cp = r.cp
+		r.hosts[name] = f
+		r.hl.Unlock()
+		return
+	}
+	r.hl.Unlock()
 
-	// if function exists, we should update!
-	// if _, ok := r.hosts[name]; ok {
-	// 	return fmt.Errorf("function already exists")
-	// }
+	if f.owner != owner {
+		log.Printf("function %s belongs to %s, keeping it instead of %s", name, f.owner, owner)
+	}
 
-	r.hosts[name] = f
+	f.setEndpoints(ips)
+}
+
+// AddEndpoints adds containers to a function, containers the function already knows are skipped
+func (r *RProxy) AddEndpoints(name string, ips []string) error {
+	f, err := r.function(name)
+	if err != nil {
+		return err
+	}
+
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	f.addEndpoints(ips)
 	return nil
 }
 
-func (r *RProxy) Del(name string) error {
+// RemoveEndpoints removes containers from a function, unknown containers are skipped.
+// Containers which serve a session get no new sessions and are dropped once the session ends.
+func (r *RProxy) RemoveEndpoints(name string, ips []string) error {
+	f, err := r.function(name)
+	if err != nil {
+		return err
+	}
+
+	f.hl.Lock()
+	defer f.hl.Unlock()
+
+	f.removeEndpoints(ips)
+	return nil
+}
+
+// Settings returns the settings of a function
+func (r *RProxy) Settings(name string) (Settings, error) {
+	f, err := r.function(name)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return f.getSettings(), nil
+}
+
+// SetSettings replaces the settings of a function, sessions which already wait keep their timeout
+func (r *RProxy) SetSettings(name string, settings Settings) error {
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+
+	f, err := r.function(name)
+	if err != nil {
+		return err
+	}
+
+	f.setSettings(settings)
+	return nil
+}
+
+func (r *RProxy) function(name string) (*Function, error) {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	f, ok := r.hosts[name]
+	if !ok {
+		return nil, ErrFunctionNotFound
+	}
+
+	return f, nil
+}
+
+// Del removes a function and the routes to it from the proxy. Unless force is set, a function with
+// containers in use is kept and ErrFunctionInUse is returned.
+func (r *RProxy) Del(name string, force bool) error {
 	r.hl.Lock()
 	defer r.hl.Unlock()
 
-	if _, ok := r.hosts[name]; !ok {
-		return fmt.Errorf("function not found")
+	f, ok := r.hosts[name]
+	if !ok {
+		return ErrFunctionNotFound
+	}
+
+	if inUse := f.inUse(); inUse > 0 && !force {
+		log.Printf("function %s has %d containers in use, not removing it", name, inUse)
+		return ErrFunctionInUse
 	}
 
 	delete(r.hosts, name)
+	r.dropRoutes(name)
 	return nil
 }
 
+// Shutdown stops accepting new sessions and waits for the active sessions to end.
+// Sessions which are still active once ctx is done get cut off with a going away close frame.
+func (r *RProxy) Shutdown(ctx context.Context) error {
+	r.sl.Lock()
+	r.draining = true
+	r.sl.Unlock()
+
+	ticker := time.NewTicker(ShutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.sl.Lock()
+		active := len(r.sessions)
+		r.sl.Unlock()
+
+		if active == 0 {
+			log.Printf("all sessions drained")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("cutting off %d active sessions", active)
+			r.sl.Lock()
+			for conn := range r.sessions {
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy is shutting down"),
+					time.Now().Add(time.Second),
+				)
+				conn.Close()
+			}
+			r.sl.Unlock()
+			return fmt.Errorf("cut off %d active sessions: %w", active, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackSession registers a client connection, it returns false if the proxy is shutting down
+func (r *RProxy) trackSession(conn *websocket.Conn) bool {
+	r.sl.Lock()
+	defer r.sl.Unlock()
+
+	if r.draining {
+		return false
+	}
+
+	r.sessions[conn] = struct{}{}
+	return true
+}
+
+func (r *RProxy) untrackSession(conn *websocket.Conn) {
+	r.sl.Lock()
+	defer r.sl.Unlock()
+
+	delete(r.sessions, conn)
+}
+
 func (r *RProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log.Printf("received req: %v", req.URL)
+	// the query may carry credentials, so it is not logged
+	log.Printf("received req: %v", req.URL.Path)
+
+	r.sl.Lock()
+	draining := r.draining
+	r.sl.Unlock()
+	if draining {
+		http.Error(w, "proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	functionName := req.URL.Path
 
 	if functionName == "" || functionName == "/" {
 		http.Error(w, "function-name must include the name of the function", http.StatusBadRequest)
-		log.Printf("receive rerquest must include the name of the function, received: %+v", req)
+		log.Printf("receive rerquest must include the name of the function, received: %s", req.URL.Path)
 		return
 	}
 
@@ -74,77 +318,202 @@ func (r *RProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		functionName = functionName[1:]
 	}
 
-	// Get the function backend -> Could also be a map (but it's just a single addr -> no handler just a single IP)
-	function, ok := r.hosts[functionName]
+	// the credentials of the function the path belongs to apply, for a deployment it is the function it was deployed for
+	owner := r.owner(functionName)
+	principal, err := r.authenticate(owner, req)
+	if err != nil {
+		log.Printf("rejecting session on %s: %v", functionName, err)
+		if errors.Is(err, ErrForbidden) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// a token issued to another principal is not resumed
+	token := sessionToken(req)
+	if token != "" && !r.validSessionToken(token, principal) {
+		log.Printf("ignoring session token of another principal on %s", functionName)
+		token = ""
+	}
+
+	// Get the function backend, the path is a route (<name> or <name>/<alias>) or the name of a backend
+	function, ok := r.resolve(functionName, token, req)
 	if !ok {
 		http.Error(w, "function not found", http.StatusNotFound)
 		log.Printf("function not found: %s", functionName)
 		return
 	}
 
-	// Upgrade the HTTP-Request
-	clientConn, err := r.upgrader.Upgrade(w, req, nil)
-	if err != nil {
-		//http.Error(w, fmt.Sprintf("not able to upgrade request to websocket-stream with error: %v", err), http.StatusInternalServerError)
-		log.Printf("not able to upgrade to ws-conn with err: %v", err)
+	// a route must not lead to the backend of another function, its credentials were not checked
+	if function.owner != owner {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		log.Printf("rejecting session on %s, backend %s belongs to %s", functionName, function.name, function.owner)
 		return
 	}
-	defer clientConn.Close()
 
-	log.Printf("client successfully connected to proxy")
+	// with a grace window, the client gets a token to resume the session on the same container after a reconnect
+	settings := function.getSettings()
+	var header http.Header
+	if settings.ResumeGrace > 0 {
+		if token == "" || !function.hasAffinity(token) {
+			token = r.newSessionToken(principal)
+		}
+		header = http.Header{SessionHeader: []string{token}}
+	} else {
+		token = ""
+	}
 
-	// This call simultaneously "blocks" the container
-	containerIP, err := function.getContainer()
+	// the container gets the session token and the principal, the headers of the client are not passed on
+	dialHeader := http.Header{}
+	if token != "" {
+		dialHeader.Set(SessionHeader, token)
+	}
+	if principal.Subject != "" {
+		dialHeader.Set(PrincipalHeader, principal.Subject)
+		dialHeader.Set(AuthMethodHeader, principal.Method)
+	}
+
+	// the request context is not canceled once the connection is hijacked, the watched connection cancels
+	// clientCtx instead, so the session does not wait for a container of a client which is gone
+	clientCtx, clientGone := context.WithCancel(req.Context())
+	defer clientGone()
+	ww := &watchingWriter{ResponseWriter: w, gone: clientGone}
+
+	// Upgrade the HTTP-Request
+	clientConn, err := r.upgrader.Upgrade(ww, req, header)
 	if err != nil {
-		log.Printf("Not able to get a Container for the function: %v", err)
-		//w.WriteHeader(http.StatusInternalServerError)
+		//http.Error(w, fmt.Sprintf("not able to upgrade request to websocket-stream with error: %v", err), http.StatusInternalServerError)
+		log.Printf("not able to upgrade to ws-conn with err: %v", err)
 		return
 	}
+	defer clientConn.Close()
 
-	log.Printf("containerIP: %s", containerIP)
-	functionConn, _, err := websocket.DefaultDialer.Dial(containerIP, nil)
-	if err != nil {
-		log.Printf("failed to connect to the function: %v", err)
+	if !r.trackSession(clientConn) {
 		clientConn.WriteMessage(
 			websocket.CloseMessage,
-			websocket.FormatCloseMessage(http.StatusInternalServerError, fmt.Sprintf("connecting to backend failed with err: %v", err)),
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy is shutting down"),
 		)
 		return
 	}
-	// Free the container
-	defer function.freeContainer(containerIP)
-	defer functionConn.Close()
+	defer r.untrackSession(clientConn)
 
-	log.Printf("connected to function-backend successfully")
+	log.Printf("client successfully connected to proxy")
+	function.sessions.Add(1)
 
-	// Get underlying network connections for io.Copy
-	clientNetConn := clientConn.NetConn()
-	fnNetConn := functionConn.NetConn()
+	containerIP, functionConn, err := r.dial(clientCtx, function, settings, token, dialHeader, req)
+	if err != nil {
+		if clientCtx.Err() != nil {
+			log.Printf("client of a session on %s went away before it was connected", functionName)
+			function.disconnects.Add(1)
+			return
+		}
 
-	log.Printf("the underlying connection are of Type: %T, %T", clientNetConn, fnNetConn)
+		log.Printf("Not able to connect the session to a container of the function: %v", err)
+		function.failures.Add(1)
+		// the client may come back later, the function is just busy right now
+		code := websocket.CloseInternalServerErr
+		if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) || errors.Is(err, ErrDialFailed) || errors.Is(err, context.DeadlineExceeded) {
+			code = websocket.CloseTryAgainLater
+		}
+		clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, err.Error()))
+		return
+	}
+	// the bytes the client sent while the session waited are relayed first
+	ww.conn.unwatch()
 
-	errChan := make(chan error, 2)
+	// Free the container, or hold it for the client to resume the session
+	if token != "" {
+		function.bind(token, containerIP, clientConn)
+		defer function.reserve(token, containerIP, clientConn)
+	} else {
+		defer function.freeContainer(containerIP)
+	}
+	defer functionConn.Close()
 
-	// Client -> Function
-	go func() {
-		// Write -> WriteTo, Reader -> ReadFrom
-		_, err := io.Copy(fnNetConn, clientNetConn)
-		log.Printf("client to function stream closed: %v", err)
-		errChan <- err
-	}()
+	log.Printf("connected to function-backend successfully")
 
-	// Function -> Client
-	go func() {
-		_, err := io.Copy(clientNetConn, fnNetConn)
-		log.Printf("function to client stream closed: %v", err)
-		errChan <- err
-	}()
+	// limits need to see the messages, so they are enforced by the frames relay
+	if settings.Relay == RelayFrames || settings.limited() {
+		err = r.relayFrames(&Session{
+			Function:  function.name,
+			Container: containerIP,
+			Token:     token,
+			Principal: principal,
+			Started:   time.Now(),
+			Request:   req,
+		}, settings, clientConn, functionConn)
+	} else {
+		err = relayRaw(clientConn, functionConn)
+	}
 
-	err = <-errChan
 	if err != nil {
 		log.Printf("connection closed with error: %v", err)
+		function.disconnects.Add(1)
 	} else {
 		// Connection closed, need to move the container to freeContainer
 		log.Printf("connection closed without an error")
 	}
 }
+
+// dial blocks a container of the function for a session and connects to it. A failed dial quarantines the
+// container and the session tries another one, up to DialAttempts containers within DialDeadline. The deadline
+// starts once the first container is blocked, so the time the session waited in the queue does not count.
+// The session stops once ctx is done, e.g. the client went away, containers are not blamed for that.
+func (r *RProxy) dial(ctx context.Context, function *Function, settings Settings, token string, header http.Header, req *http.Request) (string, *websocket.Conn, error) {
+	var deadline time.Time
+	for attempt := 1; ; attempt++ {
+		// a resuming client gets its reserved container back, if it is still there
+		var containerIP string
+		var resumed bool
+		if token != "" && attempt == 1 {
+			containerIP, resumed = function.resume(ctx, token)
+		}
+
+		if !resumed {
+			// a retry must not wait for a container past the dial deadline
+			waitCtx, cancel := ctx, context.CancelFunc(func() {})
+			if !deadline.IsZero() {
+				waitCtx, cancel = context.WithDeadline(ctx, deadline)
+			}
+
+			// This call simultaneously "blocks" the container
+			var err error
+			containerIP, err = function.getContainer(waitCtx, clientKey(settings.ClientKey, req))
+			cancel()
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		if deadline.IsZero() {
+			deadline = time.Now().Add(settings.DialDeadline)
+		}
+
+		log.Printf("containerIP: %s", containerIP)
+		dialCtx, cancel := context.WithDeadline(ctx, deadline)
+		functionConn, _, err := websocket.DefaultDialer.DialContext(dialCtx, containerURL(containerIP), header)
+		cancel()
+		if err == nil {
+			function.dialSucceeded(containerIP)
+			return containerIP, functionConn, nil
+		}
+
+		log.Printf("failed to connect to container %s (attempt %d/%d): %v", containerIP, attempt, settings.DialAttempts, err)
+		if dialCtx.Err() != nil {
+			// the client went away or the deadline cut the dial short, the container is not to blame
+			freeErr := function.freeContainer(containerIP)
+			if freeErr != nil {
+				log.Printf("not able to free container %s of function %s: %v", containerIP, function.name, freeErr)
+			}
+			return "", nil, fmt.Errorf("%w: %w", ErrDialFailed, dialCtx.Err())
+		}
+		function.dialFailed(containerIP)
+
+		if attempt >= settings.DialAttempts {
+			return "", nil, fmt.Errorf("%w: %w", ErrDialFailed, err)
+		}
+	}
+}
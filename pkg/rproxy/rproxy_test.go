@@ -0,0 +1,201 @@
+package rproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestProxy serves a proxy whose scale-outs are answered without new containers
+func newTestProxy(t *testing.T, settings Settings) (*RProxy, *httptest.Server) {
+	t.Helper()
+
+	cp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ips":[]}`))
+	}))
+	t.Cleanup(cp.Close)
+
+	proxy := New(settings)
+	proxy.SetControlPlane(cp.URL, cp.Client())
+
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	return proxy, srv
+}
+
+// echoContainer serves an echoing function on the function port of ip, the test is skipped if the address is not available
+func echoContainer(t *testing.T, ip string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, FunctionPort))
+	if err != nil {
+		t.Skipf("not able to serve a container on %s: %v", ip, err)
+	}
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+}
+
+// route registers a function without containers and routes its name to it
+func route(t *testing.T, proxy *RProxy, name string) {
+	t.Helper()
+
+	proxy.Register(name, "", nil)
+	err := proxy.SetRoute(name, Route{Backends: []WeightedBackend{{Backend: name, Weight: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connect opens a session on the path of the proxy
+func connect(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// A session waiting for a container stops waiting once its client is gone
+func TestSessionClientGone(t *testing.T) {
+	settings := DefaultSettings()
+	settings.QueueTimeout = time.Minute
+	proxy, srv := newTestProxy(t, settings)
+	route(t, proxy, "echo")
+
+	conn := connect(t, srv, "/echo")
+	waitFor(t, "the session to be queued", func() bool { return proxy.Status()["echo"].Queued == 1 })
+
+	conn.Close()
+	waitFor(t, "the session to leave the queue", func() bool { return proxy.Status()["echo"].Queued == 0 })
+
+	waitFor(t, "the session to end", func() bool { return proxy.Status()["echo"].Disconnects == 1 })
+	if s := proxy.Status()["echo"]; s.Errors != 0 {
+		t.Fatalf("expected a client which went away not to count as an error, got %+v", s)
+	}
+}
+
+// The dial deadline starts once the session got a container, so a session which waited longer
+// than the deadline still connects and the container is not quarantined
+func TestSessionDialDeadlineAfterQueue(t *testing.T) {
+	ip := "127.0.0.3"
+	echoContainer(t, ip)
+
+	settings := DefaultSettings()
+	settings.DialDeadline = 50 * time.Millisecond
+	proxy, srv := newTestProxy(t, settings)
+	route(t, proxy, "echo")
+
+	conn := connect(t, srv, "/echo")
+	defer conn.Close()
+	waitFor(t, "the session to be queued", func() bool { return proxy.Status()["echo"].Queued == 1 })
+
+	// bytes the client sends while it waits are relayed once it is connected
+	err := conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * settings.DialDeadline)
+	err = proxy.AddEndpoints("echo", []string{ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("expected the echo of the message, got %q, %v", msg, err)
+	}
+
+	if s := proxy.Status()["echo"]; len(s.Quarantined) != 0 || s.Used != 1 {
+		t.Fatalf("expected the session on the container, got %+v", s)
+	}
+}
+
+// handshake opens a session on the path with the bearer token and returns the status of the upgrade response
+func handshake(t *testing.T, srv *httptest.Server, path string, token string) int {
+	t.Helper()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, header)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+// Sessions on a deployment are authenticated with the credentials of the function it belongs to,
+// however the deployment is reached
+func TestSessionOwner(t *testing.T) {
+	proxy, srv := newTestProxy(t, DefaultSettings())
+
+	auth, err := NewAuth(AuthConfig{APIKeys: map[string]map[string]string{"echo": {"ci": "key-1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetAuthenticator(auth)
+
+	proxy.Register("echo-1", "echo", nil)
+	proxy.Register("plain", "", nil)
+	for route, backend := range map[string]string{"echo": "echo-1", "echo/prod": "echo-1", "chat": "echo-1"} {
+		err = proxy.SetRoute(route, Route{Backends: []WeightedBackend{{Backend: backend, Weight: 1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/echo", "", http.StatusUnauthorized},
+		{"/echo", "key-1", http.StatusSwitchingProtocols},
+		{"/echo/prod", "", http.StatusUnauthorized},
+		{"/echo/prod", "key-1", http.StatusSwitchingProtocols},
+		{"/echo-1", "", http.StatusUnauthorized},
+		{"/echo-1", "key-1", http.StatusSwitchingProtocols},
+		{"/chat", "", http.StatusForbidden},
+		{"/plain", "", http.StatusSwitchingProtocols},
+		{"/unknown", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		if status := handshake(t, srv, tt.path, tt.token); status != tt.status {
+			t.Errorf("expected %d on %s with %q, got %d", tt.status, tt.path, tt.token, status)
+		}
+	}
+}
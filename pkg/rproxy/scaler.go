@@ -0,0 +1,118 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// arrive records a new session in the arrival rate of the function, f.hl must be held.
+// The rate decays exponentially with the rate window, so it follows bursts without jumping around.
+func (f *Function) arrive(now time.Time) {
+	f.arrivalRate = f.rate(now) + 1/f.settings.RateWindow.Seconds()
+	f.lastArrival = now
+}
+
+// rate returns the current arrival rate of sessions per second, f.hl must be held
+func (f *Function) rate(now time.Time) float64 {
+	if f.lastArrival.IsZero() {
+		return 0
+	}
+
+	return f.arrivalRate * math.Exp(-now.Sub(f.lastArrival).Seconds()/f.settings.RateWindow.Seconds())
+}
+
+// batchSize returns how many containers the next scale-out should request, f.hl must be held.
+// The waiting sessions and the missing headroom are needed right away, on top of that come the
+// sessions which are expected to arrive while the new containers start.
+func (f *Function) batchSize(now time.Time) int {
+	needed := len(f.waiting) + f.settings.Headroom - len(f.freeIPs)
+	if needed <= 0 {
+		return 0
+	}
+
+	expected := int(math.Ceil(f.rate(now) * f.scaleLatency.Seconds()))
+
+	return min(needed+expected, f.settings.MaxBatch)
+}
+
+// scale starts a scale-out in the background unless one is already in flight or the function has
+// enough free containers, f.hl must be held. Concurrent sessions share the scale-out in flight.
+func (f *Function) scale() {
+	if f.scaling {
+		return
+	}
+
+	amount := f.batchSize(time.Now())
+	if amount == 0 {
+		return
+	}
+	f.scaling = true
+
+	go func() {
+		log.Printf("now trying to scale function %s by %d containers", f.name, amount)
+		start := time.Now()
+		ips, err := f.scaleFunction(amount)
+
+		f.hl.Lock()
+		defer f.hl.Unlock()
+
+		f.scaling = false
+		if err != nil {
+			// waiting sessions can still get a container which becomes free, otherwise they time out
+			log.Printf("error scaling the function: %v", err)
+			return
+		}
+
+		if len(ips) > 0 {
+			f.scaleLatency = time.Since(start)
+		}
+		f.addContainers(ips)
+
+		// as long as the control plane hands out new containers, keep going until the demand is met
+		if len(ips) > 0 {
+			f.scale()
+		}
+	}()
+}
+
+// scaleFunction asks the control plane for amount new containers and returns their ips,
+// the control plane may return fewer if the function reaches its maxThreads
+func (f *Function) scaleFunction(amount int) ([]string, error) {
+	d := struct {
+		FunctionName string `json:"name"`
+		Amount       int    `json:"amount"`
+	}{
+		FunctionName: f.name,
+		Amount:       amount,
+	}
+
+	resp, err := f.cp.post("/scale", d)
+	if err != nil || resp == nil {
+		log.Printf("error in response")
+		return nil, fmt.Errorf("resp nil or err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	log.Printf("received this response from cp: %v", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("not able to scale the function received http status code: %v", resp.StatusCode)
+	}
+
+	r := struct {
+		NewIPs []string `json:"ips"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("decoded response into r: %v", r)
+
+	return r.NewIPs, nil
+}
@@ -0,0 +1,266 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidSettings is returned if the settings of a function are not valid
+var ErrInvalidSettings = errors.New("invalid function settings")
+
+// Settings are the per function settings of the proxy
+type Settings struct {
+	// QueueSize is the maximum amount of sessions waiting for a free container, at least 1
+	QueueSize int
+	// QueueTimeout is how long a session waits for a free container
+	QueueTimeout time.Duration
+	// Headroom is the amount of free containers the proxy tries to keep ahead of new sessions
+	Headroom int
+	// MaxBatch is the maximum amount of containers requested by a single scale-out
+	MaxBatch int
+	// RateWindow is the time constant in which the arrival rate of sessions decays
+	RateWindow time.Duration
+	// DialAttempts is how many containers a session tries before it is closed, at least 1
+	DialAttempts int
+	// DialDeadline bounds the time a session spends dialing containers, including the retries
+	DialDeadline time.Duration
+	// Quarantine is how long a container is out of rotation after a failed dial
+	Quarantine time.Duration
+	// BreakerThreshold is the amount of failed dials in a row which open the circuit breaker of a container,
+	// it then stays out of rotation for BreakerCooldown and a single failed dial afterward opens it again
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Strategy is the name of the Strategy which selects the container of a session
+	Strategy string
+	// ClientKey is the name of the header or query parameter identifying a client for the hash strategy
+	ClientKey string
+	// ResumeGrace is how long the container of an ended session is reserved for the client to resume it,
+	// 0 disables session tokens
+	ResumeGrace time.Duration
+	// Relay is how sessions are relayed: RelayRaw copies the bytes, RelayFrames relays messages and runs the hooks
+	Relay string
+	// IdleTimeout closes a session without messages in either direction, WriteTimeout one which does not
+	// take a message in time and MaxDuration one which runs too long, 0 disables them
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxDuration  time.Duration
+	// MaxMessageSize limits the size of a single message and MaxBytes the payload of all messages of a session
+	// in bytes, 0 disables them. Sessions of a function with limits are relayed with the frames relay.
+	MaxMessageSize int64
+	MaxBytes       int64
+}
+
+// settingsJSON is the wire format of Settings, durations are written like "30s"
+type settingsJSON struct {
+	QueueSize        int    `json:"queueSize"`
+	QueueTimeout     string `json:"queueTimeout"`
+	Headroom         int    `json:"headroom"`
+	MaxBatch         int    `json:"maxBatch"`
+	RateWindow       string `json:"rateWindow"`
+	DialAttempts     int    `json:"dialAttempts"`
+	DialDeadline     string `json:"dialDeadline"`
+	Quarantine       string `json:"quarantine"`
+	BreakerThreshold int    `json:"breakerThreshold"`
+	BreakerCooldown  string `json:"breakerCooldown"`
+	Strategy         string `json:"strategy"`
+	ClientKey        string `json:"clientKey"`
+	ResumeGrace      string `json:"resumeGrace"`
+	Relay            string `json:"relay"`
+	IdleTimeout      string `json:"idleTimeout"`
+	WriteTimeout     string `json:"writeTimeout"`
+	MaxDuration      string `json:"maxDuration"`
+	MaxMessageSize   int64  `json:"maxMessageSize"`
+	MaxBytes         int64  `json:"maxBytes"`
+}
+
+func DefaultSettings() Settings {
+	return Settings{
+		QueueSize:        64,
+		QueueTimeout:     30 * time.Second,
+		Headroom:         1,
+		MaxBatch:         4,
+		RateWindow:       10 * time.Second,
+		DialAttempts:     3,
+		DialDeadline:     10 * time.Second,
+		Quarantine:       5 * time.Second,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Minute,
+		Strategy:         StrategyRandom,
+		Relay:            RelayRaw,
+	}
+}
+
+// Validate checks the settings for values the proxy can't work with
+func (s Settings) Validate() error {
+	if s.QueueSize < 1 {
+		return fmt.Errorf("%w: queueSize must be at least 1, is %d", ErrInvalidSettings, s.QueueSize)
+	}
+
+	if s.QueueTimeout <= 0 {
+		return fmt.Errorf("%w: queueTimeout must be positive, is %v", ErrInvalidSettings, s.QueueTimeout)
+	}
+
+	if s.Headroom < 0 {
+		return fmt.Errorf("%w: headroom must not be negative, is %d", ErrInvalidSettings, s.Headroom)
+	}
+
+	if s.MaxBatch < 1 {
+		return fmt.Errorf("%w: maxBatch must be at least 1, is %d", ErrInvalidSettings, s.MaxBatch)
+	}
+
+	if s.RateWindow <= 0 {
+		return fmt.Errorf("%w: rateWindow must be positive, is %v", ErrInvalidSettings, s.RateWindow)
+	}
+
+	if s.DialAttempts < 1 {
+		return fmt.Errorf("%w: dialAttempts must be at least 1, is %d", ErrInvalidSettings, s.DialAttempts)
+	}
+
+	if s.DialDeadline <= 0 {
+		return fmt.Errorf("%w: dialDeadline must be positive, is %v", ErrInvalidSettings, s.DialDeadline)
+	}
+
+	if s.Quarantine < 0 {
+		return fmt.Errorf("%w: quarantine must not be negative, is %v", ErrInvalidSettings, s.Quarantine)
+	}
+
+	if s.BreakerThreshold < 1 {
+		return fmt.Errorf("%w: breakerThreshold must be at least 1, is %d", ErrInvalidSettings, s.BreakerThreshold)
+	}
+
+	if s.BreakerCooldown < s.Quarantine {
+		return fmt.Errorf("%w: breakerCooldown must not be shorter than quarantine, is %v", ErrInvalidSettings, s.BreakerCooldown)
+	}
+
+	if _, ok := strategies[s.Strategy]; !ok {
+		return fmt.Errorf("%w: unknown strategy %q", ErrInvalidSettings, s.Strategy)
+	}
+
+	if s.ResumeGrace < 0 {
+		return fmt.Errorf("%w: resumeGrace must not be negative, is %v", ErrInvalidSettings, s.ResumeGrace)
+	}
+
+	if s.Relay != RelayRaw && s.Relay != RelayFrames {
+		return fmt.Errorf("%w: relay must be %q or %q, is %q", ErrInvalidSettings, RelayRaw, RelayFrames, s.Relay)
+	}
+
+	if s.IdleTimeout < 0 || s.WriteTimeout < 0 || s.MaxDuration < 0 {
+		return fmt.Errorf("%w: idleTimeout, writeTimeout and maxDuration must not be negative", ErrInvalidSettings)
+	}
+
+	if s.MaxMessageSize < 0 || s.MaxBytes < 0 {
+		return fmt.Errorf("%w: maxMessageSize and maxBytes must not be negative", ErrInvalidSettings)
+	}
+
+	return nil
+}
+
+func (s Settings) wire() settingsJSON {
+	return settingsJSON{
+		QueueSize:        s.QueueSize,
+		QueueTimeout:     s.QueueTimeout.String(),
+		Headroom:         s.Headroom,
+		MaxBatch:         s.MaxBatch,
+		RateWindow:       s.RateWindow.String(),
+		DialAttempts:     s.DialAttempts,
+		DialDeadline:     s.DialDeadline.String(),
+		Quarantine:       s.Quarantine.String(),
+		BreakerThreshold: s.BreakerThreshold,
+		BreakerCooldown:  s.BreakerCooldown.String(),
+		Strategy:         s.Strategy,
+		ClientKey:        s.ClientKey,
+		ResumeGrace:      s.ResumeGrace.String(),
+		Relay:            s.Relay,
+		IdleTimeout:      s.IdleTimeout.String(),
+		WriteTimeout:     s.WriteTimeout.String(),
+		MaxDuration:      s.MaxDuration.String(),
+		MaxMessageSize:   s.MaxMessageSize,
+		MaxBytes:         s.MaxBytes,
+	}
+}
+
+func (s Settings) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.wire())
+}
+
+// UnmarshalJSON only overrides the fields present in the document, so partial
+// updates can be applied on top of the current settings.
+func (s *Settings) UnmarshalJSON(b []byte) error {
+	j := s.wire()
+
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+
+	queueTimeout, err := time.ParseDuration(j.QueueTimeout)
+	if err != nil {
+		return fmt.Errorf("%w: queueTimeout: %v", ErrInvalidSettings, err)
+	}
+
+	rateWindow, err := time.ParseDuration(j.RateWindow)
+	if err != nil {
+		return fmt.Errorf("%w: rateWindow: %v", ErrInvalidSettings, err)
+	}
+
+	dialDeadline, err := time.ParseDuration(j.DialDeadline)
+	if err != nil {
+		return fmt.Errorf("%w: dialDeadline: %v", ErrInvalidSettings, err)
+	}
+
+	quarantine, err := time.ParseDuration(j.Quarantine)
+	if err != nil {
+		return fmt.Errorf("%w: quarantine: %v", ErrInvalidSettings, err)
+	}
+
+	breakerCooldown, err := time.ParseDuration(j.BreakerCooldown)
+	if err != nil {
+		return fmt.Errorf("%w: breakerCooldown: %v", ErrInvalidSettings, err)
+	}
+
+	resumeGrace, err := time.ParseDuration(j.ResumeGrace)
+	if err != nil {
+		return fmt.Errorf("%w: resumeGrace: %v", ErrInvalidSettings, err)
+	}
+
+	idleTimeout, err := time.ParseDuration(j.IdleTimeout)
+	if err != nil {
+		return fmt.Errorf("%w: idleTimeout: %v", ErrInvalidSettings, err)
+	}
+
+	writeTimeout, err := time.ParseDuration(j.WriteTimeout)
+	if err != nil {
+		return fmt.Errorf("%w: writeTimeout: %v", ErrInvalidSettings, err)
+	}
+
+	maxDuration, err := time.ParseDuration(j.MaxDuration)
+	if err != nil {
+		return fmt.Errorf("%w: maxDuration: %v", ErrInvalidSettings, err)
+	}
+
+	*s = Settings{
+		QueueSize:        j.QueueSize,
+		QueueTimeout:     queueTimeout,
+		Headroom:         j.Headroom,
+		MaxBatch:         j.MaxBatch,
+		RateWindow:       rateWindow,
+		DialAttempts:     j.DialAttempts,
+		DialDeadline:     dialDeadline,
+		Quarantine:       quarantine,
+		BreakerThreshold: j.BreakerThreshold,
+		BreakerCooldown:  breakerCooldown,
+		Strategy:         j.Strategy,
+		ClientKey:        j.ClientKey,
+		ResumeGrace:      resumeGrace,
+		Relay:            j.Relay,
+		IdleTimeout:      idleTimeout,
+		WriteTimeout:     writeTimeout,
+		MaxDuration:      maxDuration,
+		MaxMessageSize:   j.MaxMessageSize,
+		MaxBytes:         j.MaxBytes,
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package rproxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+const (
+	// StrategyRandom picks any free container
+	StrategyRandom = "random"
+	// StrategyLRU picks the container which has been free the longest, so every container stays warm
+	StrategyLRU = "lru"
+	// StrategyMRU picks the container which became free last, so the others age out and get scaled in
+	StrategyMRU = "mru"
+	// StrategyHash picks a container by the client key, so a client which reconnects lands on the same
+	// warm container as long as it is free. Sessions without a client key get a random container.
+	StrategyHash = "hash"
+)
+
+// Strategies are the names of the selectable strategies
+var Strategies = []string{StrategyRandom, StrategyLRU, StrategyMRU, StrategyHash}
+
+// Strategy selects the container of a session among the free containers of a function
+type Strategy interface {
+	// Select returns one of free, which is never empty. lastUsed is the time each container became free
+	// and clientKey identifies the client of the session, it is empty if the client is unknown.
+	Select(free []string, lastUsed map[string]time.Time, clientKey string) string
+}
+
+// strategies are the selectable strategies by name
+var strategies = map[string]Strategy{
+	StrategyRandom: randomStrategy{},
+	StrategyLRU:    lruStrategy{},
+	StrategyMRU:    mruStrategy{},
+	StrategyHash:   hashStrategy{},
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Select(free []string, _ map[string]time.Time, _ string) string {
+	return free[rand.Intn(len(free))]
+}
+
+type lruStrategy struct{}
+
+func (lruStrategy) Select(free []string, lastUsed map[string]time.Time, _ string) string {
+	return slices.MinFunc(free, func(a, b string) int {
+		return lastUsed[a].Compare(lastUsed[b])
+	})
+}
+
+type mruStrategy struct{}
+
+func (mruStrategy) Select(free []string, lastUsed map[string]time.Time, _ string) string {
+	return slices.MaxFunc(free, func(a, b string) int {
+		return lastUsed[a].Compare(lastUsed[b])
+	})
+}
+
+// hashStrategy uses rendezvous hashing, a client only moves if its container is not free,
+// and adding or removing other containers does not move it
+type hashStrategy struct{}
+
+func (hashStrategy) Select(free []string, lastUsed map[string]time.Time, clientKey string) string {
+	if clientKey == "" {
+		return randomStrategy{}.Select(free, lastUsed, clientKey)
+	}
+
+	return slices.MaxFunc(free, func(a, b string) int {
+		ha, hb := score(clientKey, a), score(clientKey, b)
+		switch {
+		case ha < hb:
+			return -1
+		case ha > hb:
+			return 1
+		}
+		return 0
+	})
+}
+
+// score is the rendezvous hash of a client and a container
+func score(clientKey string, containerIP string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(clientKey))
+	h.Write([]byte{0})
+	h.Write([]byte(containerIP))
+	return h.Sum64()
+}
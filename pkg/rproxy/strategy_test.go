@@ -0,0 +1,81 @@
+package rproxy
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStrategyLRUAndMRU(t *testing.T) {
+	now := time.Now()
+	free := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	lastUsed := map[string]time.Time{
+		"10.0.0.1": now.Add(-time.Minute),
+		"10.0.0.2": now.Add(-time.Hour),
+		"10.0.0.3": now,
+	}
+
+	if ip := strategies[StrategyLRU].Select(free, lastUsed, ""); ip != "10.0.0.2" {
+		t.Fatalf("expected lru to pick the container free the longest, got %s", ip)
+	}
+
+	if ip := strategies[StrategyMRU].Select(free, lastUsed, ""); ip != "10.0.0.3" {
+		t.Fatalf("expected mru to pick the container which became free last, got %s", ip)
+	}
+}
+
+// A client stays on its container while other containers come and go
+func TestStrategyHashSticky(t *testing.T) {
+	hash := strategies[StrategyHash]
+	free := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+
+	for i := range 20 {
+		client := fmt.Sprintf("client-%d", i)
+		ip := hash.Select(free, nil, client)
+
+		if again := hash.Select(free, nil, client); again != ip {
+			t.Fatalf("expected %s to land on %s again, got %s", client, ip, again)
+		}
+
+		// removing another container does not move the client
+		for _, other := range free {
+			if other == ip {
+				continue
+			}
+			rest := slices.DeleteFunc(slices.Clone(free), func(c string) bool { return c == other })
+			if got := hash.Select(rest, nil, client); got != ip {
+				t.Fatalf("expected %s to stay on %s once %s is gone, got %s", client, ip, other, got)
+			}
+		}
+
+		// a new container only takes over the clients it wins
+		got := hash.Select(append(slices.Clone(free), "10.0.0.5"), nil, client)
+		if got != ip && got != "10.0.0.5" {
+			t.Fatalf("expected %s to stay on %s or move to the new container, got %s", client, ip, got)
+		}
+	}
+}
+
+// Without a client key the hash strategy spreads the sessions like random
+func TestStrategyHashWithoutClientKey(t *testing.T) {
+	hash := strategies[StrategyHash]
+	free := []string{"10.0.0.1", "10.0.0.2"}
+
+	picked := make(map[string]bool)
+	for range 100 {
+		picked[hash.Select(free, nil, "")] = true
+	}
+
+	if len(picked) != 2 {
+		t.Fatalf("expected both containers to be picked, got %v", picked)
+	}
+}
+
+func TestStrategiesComplete(t *testing.T) {
+	for _, name := range Strategies {
+		if _, ok := strategies[name]; !ok {
+			t.Fatalf("strategy %s is listed but not selectable", name)
+		}
+	}
+}
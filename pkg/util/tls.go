@@ -0,0 +1,165 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloadInterval is how often a CertReloader checks its files for changes
+const CertReloadInterval = 10 * time.Second
+
+// CertReloader serves a certificate from files and loads it again once the files change,
+// so renewed certificates are picked up without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mtx      sync.Mutex
+	cert     *tls.Certificate
+	// modification times of the loaded files
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load reads the certificate from its files, c.mtx must be held
+func (c *CertReloader) load() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// certificate returns the current certificate, it is reloaded if the files changed since the last check.
+// A certificate which fails to load (e.g. the key was not written yet) keeps the previous one in use.
+func (c *CertReloader) certificate() *tls.Certificate {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if time.Since(c.lastCheck) < CertReloadInterval {
+		return c.cert
+	}
+	c.lastCheck = time.Now()
+
+	certInfo, certErr := os.Stat(c.certFile)
+	keyInfo, keyErr := os.Stat(c.keyFile)
+	if certErr != nil || keyErr != nil || (certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod)) {
+		return c.cert
+	}
+
+	err := c.load()
+	if err != nil {
+		log.Printf("not able to reload certificate %s, keeping the previous one: %v", c.certFile, err)
+		return c.cert
+	}
+
+	log.Printf("reloaded certificate %s", c.certFile)
+	return c.cert
+}
+
+// GetCertificate is the tls.Config.GetCertificate of a server
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate(), nil
+}
+
+// GetClientCertificate is the tls.Config.GetClientCertificate of a client
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.certificate(), nil
+}
+
+// LoadCertPool reads the PEM encoded certificates of a CA file
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// ServerTLS returns the TLS config of a server with the certificate of the reloader. With a CA file, client
+// certificates signed by it are verified if a client presents one, handlers check whether one was presented.
+func ServerTLS(reloader *CertReloader, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if caFile == "" {
+		return config, nil
+	}
+
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return config, nil
+}
+
+// ClientTLS returns the TLS config of a client which verifies servers with the CA file, or the system
+// CAs if it is empty. With a reloader, the client presents its certificate for mutual TLS.
+func ClientTLS(caFile string, reloader *CertReloader) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if reloader != nil {
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return config, nil
+}
+
+// HasClientCert reports whether the client of a connection presented a verified certificate
+func HasClientCert(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
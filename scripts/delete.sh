@@ -1,6 +1,6 @@
 #!/bin/bash
 
-# delete.sh function-name
+# delete.sh function-name [force]
 
 set -e
 
@@ -10,4 +10,13 @@ then
   exit
 fi
 
-curl http://localhost:8090/delete --data "{\"name\": \"$1\"}"
\ No newline at end of file
+# https://... if the control plane serves TLS, curl verifies it with the CA of CURL_CA_BUNDLE
+url=${AUBE_URL:-http://localhost:8090}
+
+# the token of a credential of the management API, see -auth-config of the control plane
+auth=()
+if [ -n "$AUBE_TOKEN" ]; then
+  auth=(-H "Authorization: Bearer $AUBE_TOKEN")
+fi
+
+curl "${auth[@]}" "${url}"/delete --data "{\"name\": \"$1\", \"force\": ${2:-false}}"
\ No newline at end of file
@@ -0,0 +1,22 @@
+#!/bin/bash
+
+# rollback.sh function-name version [alias]
+
+set -e
+
+if ! command -v curl &> /dev/null
+then
+  echo "curl could not be found but is a prerequisite for this script"
+  exit
+fi
+
+# https://... if the control plane serves TLS, curl verifies it with the CA of CURL_CA_BUNDLE
+url=${AUBE_URL:-http://localhost:8090}
+
+# the token of a credential of the management API, see -auth-config of the control plane
+auth=()
+if [ -n "$AUBE_TOKEN" ]; then
+  auth=(-H "Authorization: Bearer $AUBE_TOKEN")
+fi
+
+curl "${auth[@]}" -X PUT "${url}/functions/$1/aliases/${3:-latest}" --data "{\"version\": $2}"
@@ -1,6 +1,6 @@
 #!/bin/bash
 
-# upload.sh folder-name name
+# upload.sh folder-name name [config-json]
 
 
 set -e
@@ -23,6 +23,15 @@ then
   exit
 fi
 
+# https://... if the control plane serves TLS, curl verifies it with the CA of CURL_CA_BUNDLE
+url=${AUBE_URL:-http://localhost:8090}
+
+# the token of a credential of the management API, see -auth-config of the control plane
+auth=()
+if [ -n "$AUBE_TOKEN" ]; then
+  auth=(-H "Authorization: Bearer $AUBE_TOKEN")
+fi
+
 pushd "$1" >/dev/null || exit
-curl http://localhost:8090/upload --data "{\"name\":\"$2\", \"zip\": \"$(zip -r - ./* | base64 | tr -d '\n')\"}"
+curl "${auth[@]}" "${url}"/upload --data "{\"name\":\"$2\", \"config\": ${3:-null}, \"zip\": \"$(zip -r - ./* | base64 | tr -d '\n')\"}"
 popd >/dev/null || exit
\ No newline at end of file